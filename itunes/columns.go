@@ -0,0 +1,297 @@
+package itunes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Column is a field of a track, or of the playlist it's in, that can be
+// selected for the table, CSV, and JSON output.
+type Column struct {
+	// Name identifies the column in a column list, and is its key in JSON
+	// output. Names match the JSON field names of Track where there is one.
+	Name string
+	// Header is the column's heading in table and CSV output.
+	Header string
+	// text renders the value for the table. csv and json, if set, render it
+	// for those formats instead; otherwise CSV uses the text and JSON uses
+	// the text as a string.
+	text func(p Playlist, t Track) string
+	csv  func(p Playlist, t Track) string
+	json func(p Playlist, t Track) interface{}
+	// date, if set, gets the date a date column shows, for WithDateFormat.
+	date func(t Track) time.Time
+}
+
+// Text returns the column's value for track t in playlist p as shown in the table.
+func (c Column) Text(p Playlist, t Track) string {
+	return c.text(p, t)
+}
+
+// CSV returns the column's value for track t in playlist p as written to CSV.
+func (c Column) CSV(p Playlist, t Track) string {
+	if c.csv != nil {
+		return c.csv(p, t)
+	}
+	return c.text(p, t)
+}
+
+// JSON returns the column's value for track t in playlist p as written to JSON.
+func (c Column) JSON(p Playlist, t Track) interface{} {
+	if c.json != nil {
+		return c.json(p, t)
+	}
+	return c.text(p, t)
+}
+
+// itoaOrBlank renders a number, leaving unknown (zero) values blank.
+func itoaOrBlank(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// allColumns lists every column that can be selected, in the order they are
+// documented.
+var allColumns = []Column{
+	{Name: "playlist", Header: "Playlist Name", text: func(p Playlist, t Track) string { return p.Name }},
+	{Name: "smart", Header: "Smart",
+		text: func(p Playlist, t Track) string {
+			if p.IsSmart {
+				return "yes"
+			}
+			return ""
+		},
+		csv:  func(p Playlist, t Track) string { return strconv.FormatBool(p.IsSmart) },
+		json: func(p Playlist, t Track) interface{} { return p.IsSmart }},
+	{Name: "id", Header: "ID",
+		text: func(p Playlist, t Track) string { return strconv.FormatInt(t.ID, 10) },
+		json: func(p Playlist, t Track) interface{} { return t.ID }},
+	{Name: "artist", Header: "Artist", text: func(p Playlist, t Track) string { return t.Artist }},
+	{Name: "album", Header: "Album", text: func(p Playlist, t Track) string { return t.Album }},
+	{Name: "album_artist", Header: "Album Artist", text: func(p Playlist, t Track) string { return t.AlbumArtist }},
+	{Name: "name", Header: "Track", text: func(p Playlist, t Track) string { return t.Name }},
+	{Name: "genre", Header: "Genre", text: func(p Playlist, t Track) string { return t.Genre }},
+	{Name: "grouping", Header: "Grouping", text: func(p Playlist, t Track) string { return t.Grouping }},
+	{Name: "composer", Header: "Composer", text: func(p Playlist, t Track) string { return t.Composer }},
+	{Name: "comments", Header: "Comments", text: func(p Playlist, t Track) string { return t.Comments }},
+	{Name: "year", Header: "Year",
+		text: func(p Playlist, t Track) string { return itoaOrBlank(t.Year) },
+		json: func(p Playlist, t Track) interface{} { return t.Year }},
+	{Name: "disc_number", Header: "Disc",
+		text: func(p Playlist, t Track) string { return itoaOrBlank(t.DiscNumber) },
+		json: func(p Playlist, t Track) interface{} { return t.DiscNumber }},
+	{Name: "track_number", Header: "Track No.",
+		text: func(p Playlist, t Track) string { return itoaOrBlank(t.TrackNumber) },
+		json: func(p Playlist, t Track) interface{} { return t.TrackNumber }},
+	{Name: "play_count", Header: "Plays",
+		text: func(p Playlist, t Track) string { return strconv.Itoa(t.PlayCount) },
+		json: func(p Playlist, t Track) interface{} { return t.PlayCount }},
+	{Name: "rating", Header: "Rating",
+		text: func(p Playlist, t Track) string { return formatStars(t.Rating) },
+		csv:  func(p Playlist, t Track) string { return strconv.Itoa(t.Rating) },
+		json: func(p Playlist, t Track) interface{} { return t.Rating }},
+	{Name: "bpm", Header: "BPM",
+		text: func(p Playlist, t Track) string { return itoaOrBlank(t.BPM) },
+		json: func(p Playlist, t Track) interface{} { return t.BPM }},
+	{Name: "key", Header: "Key", text: func(p Playlist, t Track) string { return t.Key }},
+	{Name: "duration", Header: "Length",
+		text: func(p Playlist, t Track) string { return formatDuration(t.Duration) },
+		json: func(p Playlist, t Track) interface{} { return t.Duration }},
+	{Name: "size", Header: "Size",
+		text: func(p Playlist, t Track) string {
+			if t.Size == 0 {
+				return ""
+			}
+			return humanSize(t.Size)
+		},
+		csv:  func(p Playlist, t Track) string { return strconv.FormatInt(t.Size, 10) },
+		json: func(p Playlist, t Track) interface{} { return t.Size }},
+	{Name: "location", Header: "Location", text: func(p Playlist, t Track) string { return t.Location }},
+	dateColumn("date_added", "Date Added", DefaultDateFormat, func(t Track) time.Time { return t.DateAdded.Time }),
+	dateColumn("date_modified", "Date Modified", DefaultDateFormat, func(t Track) time.Time { return t.DateModified.Time }),
+	dateColumn("play_date", "Play Date", DefaultDateFormat, func(t Track) time.Time { return t.PlayDate.Time }),
+}
+
+// DefaultDateFormat is the layout date columns are written with unless
+// WithDateFormat gives them another.
+const DefaultDateFormat = "2006-01-02"
+
+// dateColumn makes a column for one of a track's dates, written with the
+// given layout. Tracks without the date are left blank, or null in JSON.
+func dateColumn(name, header, layout string, date func(Track) time.Time) Column {
+	return Column{Name: name, Header: header,
+		text: func(p Playlist, t Track) string {
+			if date(t).IsZero() {
+				return ""
+			}
+			return date(t).Format(layout)
+		},
+		json: func(p Playlist, t Track) interface{} {
+			if date(t).IsZero() {
+				return nil
+			}
+			return date(t)
+		},
+		date: date}
+}
+
+// WithDateFormat returns the columns with any date columns changed to write
+// dates in the table and CSV output with the given time layout, such as
+// "02/01/2006". JSON output always has RFC 3339 timestamps.
+func WithDateFormat(cols []Column, layout string) []Column {
+	out := make([]Column, len(cols))
+	for i, c := range cols {
+		if c.date != nil {
+			c = dateColumn(c.Name, c.Header, layout, c.date)
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// defaultColumnNames are the columns written when none are chosen.
+var defaultColumnNames = []string{"playlist", "artist", "album", "name", "genre", "duration", "play_count", "rating"}
+
+// presets are the named column lists that PresetColumns expands. The full
+// preset isn't listed, as it is every column there is.
+var presets = map[string][]string{
+	"minimal":  {"artist", "name"},
+	"standard": defaultColumnNames,
+	"dj":       {"artist", "name", "bpm", "duration", "key"},
+}
+
+// PresetColumns returns the columns of a named preset: minimal, standard (the
+// default columns), full (every column), or dj.
+func PresetColumns(name string) ([]Column, error) {
+	names, ok := presets[name]
+	if name == "full" {
+		names, ok = ColumnNames(), true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q (known presets: minimal, standard, full, dj)", name)
+	}
+	return ParseColumns(strings.Join(names, ","))
+}
+
+// ColumnNames returns the names of all the columns that can be selected.
+func ColumnNames() []string {
+	names := make([]string, len(allColumns))
+	for i, c := range allColumns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// ParseColumns looks up the columns in a comma-separated list of column
+// names, keeping the order they are given in. An error is returned for any
+// name that isn't a known column.
+func ParseColumns(list string) ([]Column, error) {
+	var cols []Column
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		c, ok := columnByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q (known columns: %s)", name, strings.Join(ColumnNames(), ", "))
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+func columnByName(name string) (Column, bool) {
+	for _, c := range allColumns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// mustColumns looks up columns that are known to exist.
+func mustColumns(names ...string) []Column {
+	cols, err := ParseColumns(strings.Join(names, ","))
+	if err != nil {
+		panic(err)
+	}
+	return cols
+}
+
+// selectColumns returns the chosen columns, or the default columns if none
+// were chosen, with the location column added at the end if withLocation is
+// set and it isn't already there.
+func selectColumns(cols []Column, withLocation bool) []Column {
+	if len(cols) == 0 {
+		cols = mustColumns(defaultColumnNames...)
+	}
+	if withLocation {
+		for _, c := range cols {
+			if c.Name == "location" {
+				return cols
+			}
+		}
+		cols = append(cols[:len(cols):len(cols)], mustColumns("location")...)
+	}
+	return cols
+}
+
+// ColumnWidths works out how wide each column needs to be to fit the widest
+// entry across the playlists, or its header. Widths are counted in runes
+// rather than bytes so that non-ASCII names line up.
+func (ps Playlists) ColumnWidths(cols []Column) []int {
+	widths := make([]int, len(cols))
+	for i, c := range cols {
+		widths[i] = utf8.RuneCountInString(c.Header)
+	}
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			for i, c := range cols {
+				if l := utf8.RuneCountInString(c.Text(p, t)); l > widths[i] {
+					widths[i] = l
+				}
+			}
+		}
+	}
+	return widths
+}
+
+// columnRecord is a track's values for a set of columns. It marshals to a
+// JSON object with the keys in column order.
+type columnRecord struct {
+	cols     []Column
+	playlist Playlist
+	track    Track
+	// checksum adds the checksum of the track's row as a last field
+	checksum bool
+}
+
+func (r columnRecord) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBufferString("{")
+	for i, c := range r.cols {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key, err := json.Marshal(c.Name)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(c.JSON(r.playlist, r.track))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(val)
+	}
+	if r.checksum {
+		fmt.Fprintf(buf, `,"checksum":%q`, csvChecksum(r.cols, r.playlist, r.track))
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
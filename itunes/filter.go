@@ -0,0 +1,577 @@
+package itunes
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// FilterByPlaylist returns only the playlists whose name contains the given
+// string, ignoring case.
+func (ps Playlists) FilterByPlaylist(name string) Playlists {
+	name = strings.ToLower(name)
+	var out Playlists
+	for _, p := range ps {
+		if strings.Contains(strings.ToLower(p.Name), name) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// FilterByPlaylistRegexp returns only the playlists whose name matches the
+// given regular expression.
+func (ps Playlists) FilterByPlaylistRegexp(re *regexp.Regexp) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		if re.MatchString(p.Name) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// FilterByArtist returns the playlists with only the tracks whose artist
+// matches the given name, ignoring case. Playlists left with no tracks are
+// dropped.
+func (ps Playlists) FilterByArtist(name string) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if strings.EqualFold(t.Artist, name) {
+				tracks = append(tracks, t)
+			}
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterByGenre returns the playlists with only the tracks whose genre
+// matches the given genre, ignoring case. Playlists left with no tracks are
+// dropped.
+func (ps Playlists) FilterByGenre(g string) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if strings.EqualFold(t.Genre, g) {
+				tracks = append(tracks, t)
+			}
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterByArtistRegexp returns the playlists with only the tracks whose
+// artist matches the given regular expression. Playlists left with no tracks
+// are dropped.
+func (ps Playlists) FilterByArtistRegexp(re *regexp.Regexp) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if re.MatchString(t.Artist) {
+				tracks = append(tracks, t)
+			}
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterByName returns the playlists with only the tracks whose name matches
+// the given regular expression. Playlists left with no tracks are dropped.
+func (ps Playlists) FilterByName(re *regexp.Regexp) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if re.MatchString(t.Name) {
+				tracks = append(tracks, t)
+			}
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterByGrouping returns the playlists with only the tracks whose grouping
+// matches one of the given groupings (case-insensitive). Playlists left with
+// no tracks are dropped.
+func (ps Playlists) FilterByGrouping(groupings []string) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			for _, g := range groupings {
+				if strings.EqualFold(t.Grouping, g) {
+					tracks = append(tracks, t)
+					break
+				}
+			}
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterByBPM returns the playlists with only the tracks whose BPM is within
+// the given inclusive range. A max of 0 means there is no upper bound. Tracks
+// with no BPM are always dropped. Playlists left with no tracks are dropped.
+func (ps Playlists) FilterByBPM(min, max int) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if t.BPM == 0 || t.BPM < min || (max > 0 && t.BPM > max) {
+				continue
+			}
+			tracks = append(tracks, t)
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterByDateAdded returns the playlists with only the tracks added on or
+// after after and before before. A zero time leaves that end of the range
+// open. Tracks with no date added are always dropped. Playlists left with no
+// tracks are dropped.
+func (ps Playlists) FilterByDateAdded(after, before time.Time) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if t.DateAdded.IsZero() || t.DateAdded.Before(after) || (!before.IsZero() && !t.DateAdded.Before(before)) {
+				continue
+			}
+			tracks = append(tracks, t)
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// FilterBySmart returns only the smart playlists if smart is set, or only the
+// ordinary playlists if not.
+func (ps Playlists) FilterBySmart(smart bool) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		if p.IsSmart == smart {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// FilterByRating returns the playlists with only the tracks rated at least
+// the given number of stars. Ratings are stored as 0-100, 20 per star.
+// Playlists left with no tracks are dropped.
+func (ps Playlists) FilterByRating(minStars int) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		var tracks []Track
+		for _, t := range p.Tracks {
+			if t.Rating < minStars*20 {
+				continue
+			}
+			tracks = append(tracks, t)
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		p.Tracks = tracks
+		out = append(out, p)
+	}
+	return out
+}
+
+// Dedupe removes repeated tracks from the playlist, keeping the first
+// occurrence of each. By "metadata", tracks are considered the same if they
+// have the same artist, album, and name; by "persistent-id" or "location",
+// if they have the same persistent ID or file. An error is returned, and the
+// playlist left as is, if any track lacks the field being deduped by.
+//
+// With fold set, the metadata is compared ignoring case, accents, and Unicode
+// normalization, so "Beyoncé" and "BEYONCE" are the same artist. The tracks
+// that are kept are written as they are.
+func (p *Playlist) Dedupe(by string, fold bool) error {
+	type trackKey struct{ artist, album, name string }
+	var key func(Track) (trackKey, bool)
+	switch by {
+	case "metadata":
+		same := func(s string) string { return s }
+		if fold {
+			same = foldKey
+		}
+		key = func(t Track) (trackKey, bool) { return trackKey{same(t.Artist), same(t.Album), same(t.Name)}, true }
+	case "persistent-id":
+		key = func(t Track) (trackKey, bool) { return trackKey{name: t.PersistentID}, t.PersistentID != "" }
+	case "location":
+		key = func(t Track) (trackKey, bool) { return trackKey{name: t.filePath()}, t.filePath() != "" }
+	default:
+		return fmt.Errorf("unknown dedupe key %q", by)
+	}
+	keys := make([]trackKey, len(p.Tracks))
+	for i, t := range p.Tracks {
+		k, ok := key(t)
+		if !ok {
+			return fmt.Errorf("track %q in playlist %s has no %s to dedupe by", t.Name, p.Name, by)
+		}
+		keys[i] = k
+	}
+	seen := make(map[trackKey]bool)
+	tracks := p.Tracks[:0]
+	for i, t := range p.Tracks {
+		if seen[keys[i]] {
+			continue
+		}
+		seen[keys[i]] = true
+		tracks = append(tracks, t)
+	}
+	p.Tracks = tracks
+	return nil
+}
+
+// foldKey folds s for comparison: accents are dropped, leaving the text in
+// NFC, and the case is folded, so that strings differing only in those ways
+// fold to the same key.
+func foldKey(s string) string {
+	stripped, _, err := transform.String(stripMarks, s)
+	if err != nil {
+		stripped = s
+	}
+	return cases.Fold().String(stripped)
+}
+
+// lessByFields compares two tracks field by field, moving on to the next field
+// only when the previous ones are equal.
+func lessByFields(a, b Track, fields ...func(Track) string) bool {
+	for _, field := range fields {
+		if fa, fb := field(a), field(b); fa != fb {
+			return fa < fb
+		}
+	}
+	return false
+}
+
+func trackArtist(t Track) string { return t.Artist }
+func trackAlbum(t Track) string  { return t.Album }
+func trackName(t Track) string   { return t.Name }
+
+// Sort sorts the playlist's tracks by the given field. Sorting by artist,
+// album, or name falls back on the other two of those fields to break ties,
+// and tracks that still compare equal keep their playlist order. Within an
+// album, sorting by album puts tracks in disc and track number order first.
+// Sorting by "none" leaves the order as is.
+func (p *Playlist) Sort(by string) {
+	var less func(a, b Track) bool
+	switch by {
+	case "artist":
+		less = func(a, b Track) bool { return lessByFields(a, b, trackArtist, trackAlbum, trackName) }
+	case "album":
+		less = func(a, b Track) bool {
+			if a.Album != b.Album {
+				return a.Album < b.Album
+			}
+			if a.DiscNumber != b.DiscNumber {
+				return a.DiscNumber < b.DiscNumber
+			}
+			if a.TrackNumber != b.TrackNumber {
+				return a.TrackNumber < b.TrackNumber
+			}
+			return lessByFields(a, b, trackArtist, trackName)
+		}
+	case "name":
+		less = func(a, b Track) bool { return lessByFields(a, b, trackName, trackArtist, trackAlbum) }
+	case "bpm":
+		less = func(a, b Track) bool { return a.BPM < b.BPM }
+	case "key":
+		less = func(a, b Track) bool { return a.Key < b.Key }
+	default:
+		return
+	}
+	sort.SliceStable(p.Tracks, func(i, j int) bool {
+		return less(p.Tracks[i], p.Tracks[j])
+	})
+}
+
+// Canonicalize sorts the playlists by name and the tracks within each playlist
+// by artist, album, name, and then year, so that the same library always
+// produces the same output regardless of playlist order in the export.
+func (ps Playlists) Canonicalize() {
+	sort.SliceStable(ps, func(i, j int) bool {
+		return ps[i].Name < ps[j].Name
+	})
+	for _, p := range ps {
+		sort.SliceStable(p.Tracks, func(i, j int) bool {
+			a, b := p.Tracks[i], p.Tracks[j]
+			if a.Artist != b.Artist {
+				return a.Artist < b.Artist
+			}
+			if a.Album != b.Album {
+				return a.Album < b.Album
+			}
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			return a.Year < b.Year
+		})
+	}
+}
+
+// zeroPlayWeight is the weight given to never-played tracks when sampling by
+// play count, so that they can still be picked occasionally.
+const zeroPlayWeight = 0.1
+
+// Sample picks n distinct tracks at random from across the playlists,
+// returning them as a single playlist called "Sample". If byPlays is set,
+// tracks are weighted by their play count so that frequently played tracks
+// are more likely to be picked. The same seed always gives the same sample.
+func (ps Playlists) Sample(n int, byPlays bool, seed int64) Playlists {
+	// Collect each distinct track once, in the order they first appear
+	seen := make(map[Track]bool)
+	var pool []Track
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			if !seen[t] {
+				seen[t] = true
+				pool = append(pool, t)
+			}
+		}
+	}
+	// Weighted sampling without replacement (Efraimidis-Spirakis): give each
+	// track a random key of u^(1/weight) and keep the n largest keys.
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([]float64, len(pool))
+	for i, t := range pool {
+		weight := 1.0
+		if byPlays {
+			weight = zeroPlayWeight
+			if t.PlayCount > 0 {
+				weight = float64(t.PlayCount)
+			}
+		}
+		keys[i] = math.Pow(rng.Float64(), 1/weight)
+	}
+	order := make([]int, len(pool))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return keys[order[i]] > keys[order[j]]
+	})
+	if n > len(order) {
+		n = len(order)
+	}
+	sample := Playlist{Name: "Sample"}
+	for _, i := range order[:n] {
+		sample.Tracks = append(sample.Tracks, pool[i])
+	}
+	return Playlists{sample}
+}
+
+// SamplePlaylists picks n of the playlists at random, keeping them in their
+// original order. The same seed always gives the same selection.
+func (ps Playlists) SamplePlaylists(n int, seed int64) Playlists {
+	if n >= len(ps) {
+		return ps
+	}
+	picked := rand.New(rand.NewSource(seed)).Perm(len(ps))[:n]
+	sort.Ints(picked)
+	out := make(Playlists, 0, n)
+	for _, i := range picked {
+		out = append(out, ps[i])
+	}
+	return out
+}
+
+// GroupByDecade regroups the tracks from all the playlists into one section
+// per release decade (e.g. "1980s"), in chronological order. Tracks with no
+// year are put in a final "Unknown" section.
+func (ps Playlists) GroupByDecade() Playlists {
+	byDecade := make(map[int][]Track)
+	var unknown []Track
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			if t.Year == 0 {
+				unknown = append(unknown, t)
+				continue
+			}
+			decade := t.Year - t.Year%10
+			byDecade[decade] = append(byDecade[decade], t)
+		}
+	}
+	decades := make([]int, 0, len(byDecade))
+	for d := range byDecade {
+		decades = append(decades, d)
+	}
+	sort.Ints(decades)
+	var out Playlists
+	for _, d := range decades {
+		out = append(out, Playlist{Name: fmt.Sprintf("%ds", d), Tracks: byDecade[d]})
+	}
+	if len(unknown) > 0 {
+		out = append(out, Playlist{Name: "Unknown", Tracks: unknown})
+	}
+	return out
+}
+
+// GroupByAlbum regroups the tracks from all the playlists into one section
+// per album, named "Album Artist - Album" and sorted by album artist then
+// album name. Grouping on the album artist rather than the track artist keeps
+// compilations together. If albumOnly is set, albums are identified by the
+// album name alone, as in Discography, and an album whose tracks have
+// different album artists is put under "Various Artists".
+func (ps Playlists) GroupByAlbum(albumOnly bool) Playlists {
+	type albumKey struct{ artist, album string }
+	type section struct {
+		artist string
+		tracks []Track
+	}
+	byAlbum := make(map[albumKey]*section)
+	var albums []*section
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			k := albumKey{t.AlbumArtist, t.Album}
+			if albumOnly {
+				k = albumKey{album: t.Album}
+			}
+			s, ok := byAlbum[k]
+			if !ok {
+				s = &section{artist: t.AlbumArtist}
+				byAlbum[k] = s
+				albums = append(albums, s)
+			} else if s.artist != t.AlbumArtist {
+				s.artist = variousArtists
+			}
+			s.tracks = append(s.tracks, t)
+		}
+	}
+	sort.Slice(albums, func(i, j int) bool {
+		if albums[i].artist != albums[j].artist {
+			return albums[i].artist < albums[j].artist
+		}
+		return albums[i].tracks[0].Album < albums[j].tracks[0].Album
+	})
+	var out Playlists
+	for _, s := range albums {
+		out = append(out, Playlist{Name: s.artist + " - " + s.tracks[0].Album, Tracks: s.tracks})
+	}
+	return out
+}
+
+// asciiFallbacks holds ASCII spellings for common characters that don't
+// decompose into an ASCII base letter plus combining marks.
+var asciiFallbacks = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D",
+	'þ': "th", 'Þ': "Th", 'ð': "d", 'Ð': "D", 'ı': "i",
+	'‘': "'", '’': "'", '‚': "'", '“': "\"", '”': "\"", '„': "\"",
+	'–': "-", '—': "-", '…': "...", '\u00a0': " ",
+}
+
+// stripMarks decomposes characters and drops the combining marks, so that
+// e.g. 'é' becomes 'e'.
+var stripMarks = transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+// toASCII transliterates s to its closest ASCII equivalent. Characters with no
+// sensible equivalent are replaced by '?'.
+func toASCII(s string) string {
+	stripped, _, err := transform.String(stripMarks, s)
+	if err != nil {
+		stripped = s
+	}
+	var b strings.Builder
+	for _, r := range stripped {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+		} else if alt, ok := asciiFallbacks[r]; ok {
+			b.WriteString(alt)
+		} else {
+			b.WriteRune('?')
+		}
+	}
+	return b.String()
+}
+
+// ToASCII transliterates every playlist and track field to ASCII in place.
+func (ps Playlists) ToASCII() {
+	for i := range ps {
+		ps[i].Name = toASCII(ps[i].Name)
+		for j := range ps[i].Tracks {
+			t := &ps[i].Tracks[j]
+			t.Artist = toASCII(t.Artist)
+			t.Album = toASCII(t.Album)
+			t.AlbumArtist = toASCII(t.AlbumArtist)
+			t.Name = toASCII(t.Name)
+			t.Genre = toASCII(t.Genre)
+			t.Grouping = toASCII(t.Grouping)
+			t.Composer = toASCII(t.Composer)
+			t.Comments = toASCII(t.Comments)
+			t.Key = toASCII(t.Key)
+		}
+	}
+}
+
+// trimSuffixes strips any of the given suffixes from the end of s, ignoring
+// case, along with any whitespace left in front of them.
+func trimSuffixes(s string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		if len(suffix) <= len(s) && strings.EqualFold(s[len(s)-len(suffix):], suffix) {
+			s = strings.TrimRightFunc(s[:len(s)-len(suffix)], unicode.IsSpace)
+		}
+	}
+	return s
+}
+
+// TrimNameSuffixes strips the given suffixes from every track name in place.
+func (ps Playlists) TrimNameSuffixes(suffixes []string) {
+	for i := range ps {
+		for j := range ps[i].Tracks {
+			ps[i].Tracks[j].Name = trimSuffixes(ps[i].Tracks[j].Name, suffixes)
+		}
+	}
+}
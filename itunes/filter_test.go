@@ -0,0 +1,350 @@
+package itunes
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+// playlistNames returns the names of the playlists, in order.
+func playlistNames(ps Playlists) []string {
+	var names []string
+	for _, p := range ps {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// trackNames returns the names of the playlist's tracks, in order.
+func trackNames(p Playlist) []string {
+	var names []string
+	for _, t := range p.Tracks {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+func TestDedupe(t *testing.T) {
+	tracks := []Track{
+		{Name: "a", Artist: "X", Album: "A", PersistentID: "P1", Location: "/m/1.mp3"},
+		{Name: "a", Artist: "X", Album: "A", PersistentID: "P2", Location: "/m/2.mp3"},
+		{Name: "c", Artist: "Y", Album: "B", PersistentID: "P1", Location: "/m/3.mp3"},
+		{Name: "d", Artist: "Z", Album: "C", PersistentID: "P3", Location: "/m/2.mp3"},
+	}
+	tests := []struct {
+		by   string
+		want []string
+	}{
+		{"metadata", []string{"a", "c", "d"}},
+		{"persistent-id", []string{"a", "a", "d"}},
+		{"location", []string{"a", "a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.by, func(t *testing.T) {
+			p := Playlist{Name: "P", Tracks: append([]Track(nil), tracks...)}
+			if err := p.Dedupe(tt.by, false); err != nil {
+				t.Fatalf("Dedupe: %v", err)
+			}
+			if got := trackNames(p); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tracks = %q, want %q", got, tt.want)
+			}
+			if tt.by != "metadata" && p.Tracks[1].PersistentID != "P2" {
+				t.Errorf("second track is %+v, want the one with persistent ID P2", p.Tracks[1])
+			}
+		})
+	}
+
+	for _, by := range []string{"persistent-id", "location"} {
+		t.Run(by+" missing", func(t *testing.T) {
+			p := Playlist{Name: "P", Tracks: append(append([]Track(nil), tracks...), Track{Name: "bare"})}
+			if err := p.Dedupe(by, false); err == nil {
+				t.Errorf("Dedupe(%q) kept going with a track that has no key", by)
+			}
+			if len(p.Tracks) != len(tracks)+1 {
+				t.Errorf("playlist changed to %q after an error", trackNames(p))
+			}
+		})
+	}
+}
+
+func TestDedupeFold(t *testing.T) {
+	tracks := []Track{
+		{Name: "Halo", Artist: "Beyonc\u00e9", Album: "I Am... Sasha Fierce"},
+		{Name: "Halo", Artist: "Beyonce\u0301", Album: "I Am... Sasha Fierce"},
+		{Name: "HALO", Artist: "BEYONCE", Album: "i am... sasha fierce"},
+		{Name: "Halo", Artist: "Beyonce", Album: "Live"},
+	}
+	tests := []struct {
+		fold bool
+		want int
+	}{
+		{false, 4},
+		{true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint("fold=", tt.fold), func(t *testing.T) {
+			p := Playlist{Name: "P", Tracks: append([]Track(nil), tracks...)}
+			if err := p.Dedupe("metadata", tt.fold); err != nil {
+				t.Fatalf("Dedupe: %v", err)
+			}
+			if len(p.Tracks) != tt.want {
+				t.Errorf("kept %d tracks %+v, want %d", len(p.Tracks), p.Tracks, tt.want)
+			}
+			if p.Tracks[0] != tracks[0] {
+				t.Errorf("first track changed to %+v", p.Tracks[0])
+			}
+		})
+	}
+}
+
+func TestGroupByAlbum(t *testing.T) {
+	ps := Playlists{
+		{Name: "One", Tracks: []Track{
+			{Name: "a", Album: "Hits", AlbumArtist: "X"},
+			{Name: "b", Album: "Solo", AlbumArtist: "Z"},
+		}},
+		{Name: "Two", Tracks: []Track{
+			{Name: "c", Album: "Hits", AlbumArtist: "Y"},
+		}},
+	}
+	tests := []struct {
+		name      string
+		albumOnly bool
+		want      []string
+		wantFirst []string
+	}{
+		{"artist and album", false, []string{"X - Hits", "Y - Hits", "Z - Solo"}, []string{"a"}},
+		{"album only", true, []string{"Various Artists - Hits", "Z - Solo"}, []string{"a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ps.GroupByAlbum(tt.albumOnly)
+			if names := playlistNames(got); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("sections = %q, want %q", names, tt.want)
+			}
+			if names := trackNames(got[0]); !reflect.DeepEqual(names, tt.wantFirst) {
+				t.Errorf("first section tracks = %q, want %q", names, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestFilterByName(t *testing.T) {
+	ps := Playlists{
+		{Name: "Gigs", Tracks: []Track{
+			{Name: "Creep (Live)"},
+			{Name: "Creep"},
+			{Name: "Alive"},
+			{Name: "Karma Police (Live)"},
+		}},
+		{Name: "Studio", Tracks: []Track{{Name: "Airbag"}}},
+	}
+	got := ps.FilterByName(regexp.MustCompile(`\(Live\)`))
+	if names := playlistNames(got); !reflect.DeepEqual(names, []string{"Gigs"}) {
+		t.Errorf("playlists = %q, want only Gigs", names)
+	}
+	if names := trackNames(got[0]); !reflect.DeepEqual(names, []string{"Creep (Live)", "Karma Police (Live)"}) {
+		t.Errorf("tracks = %q, want only the live ones", names)
+	}
+}
+
+func TestFilterByGrouping(t *testing.T) {
+	ps := Playlists{{Name: "Work", Tracks: []Track{
+		{Name: "a", Grouping: "Focus"},
+		{Name: "b", Grouping: "Party"},
+		{Name: "c"},
+	}}}
+	tests := []struct {
+		name      string
+		groupings []string
+		want      []string
+	}{
+		{"one grouping", []string{"Focus"}, []string{"a"}},
+		{"ignores case", []string{"party"}, []string{"b"}},
+		{"several groupings", []string{"focus", "PARTY"}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ps.FilterByGrouping(tt.groupings)
+			if len(got) != 1 || !reflect.DeepEqual(trackNames(got[0]), tt.want) {
+				t.Errorf("got %v, want tracks %q", got, tt.want)
+			}
+		})
+	}
+	if got := ps.FilterByGrouping([]string{"Sleep"}); len(got) != 0 {
+		t.Errorf("no matches should drop the playlist, got %v", got)
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Beyoncé", "Beyonce"},
+		{"Motörhead", "Motorhead"},
+		{"Sigur Rós", "Sigur Ros"},
+		{"Straße", "Strasse"},
+		{"Don’t Stop — Live", "Don't Stop - Live"},
+		{"坂本龍一", "????"},
+		{"Plain", "Plain"},
+	}
+	for _, tt := range tests {
+		if got := toASCII(tt.in); got != tt.want {
+			t.Errorf("toASCII(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	ps := Playlists{{Name: "Café", Tracks: []Track{{Artist: "Björk", Album: "Début", Name: "Human Behaviour"}}}}
+	ps.ToASCII()
+	if got := ps[0]; got.Name != "Cafe" || got.Tracks[0].Artist != "Bjork" || got.Tracks[0].Album != "Debut" {
+		t.Errorf("ToASCII left %+v", got)
+	}
+}
+
+func TestTrimNameSuffixes(t *testing.T) {
+	ps := Playlists{{Name: "P", Tracks: []Track{
+		{Name: "Lose Yourself (Explicit)"},
+		{Name: "Stan  (explicit)"},
+		{Name: "Track.mp3"},
+		{Name: "(Explicit) Intro"},
+		{Name: "Clean"},
+	}}}
+	ps.TrimNameSuffixes([]string{"(Explicit)", ".mp3"})
+	want := []string{"Lose Yourself", "Stan", "Track", "(Explicit) Intro", "Clean"}
+	if got := trackNames(ps[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSample(t *testing.T) {
+	ps := Playlists{{Name: "P", Tracks: []Track{{Name: "hot", PlayCount: 100}}}}
+	for i := 0; i < 9; i++ {
+		ps[0].Tracks = append(ps[0].Tracks, Track{Name: fmt.Sprintf("cold %d", i)})
+	}
+
+	first := ps.Sample(3, true, 42)
+	for i := 0; i < 5; i++ {
+		if again := ps.Sample(3, true, 42); !reflect.DeepEqual(again, first) {
+			t.Fatalf("same seed gave %q then %q", trackNames(first[0]), trackNames(again[0]))
+		}
+	}
+	if len(first) != 1 || first[0].Name != "Sample" || len(first[0].Tracks) != 3 {
+		t.Errorf("Sample(3) = %v, want one Sample playlist of 3 tracks", first)
+	}
+
+	// Over many seeds the much-played track should nearly always be picked
+	// first when weighted by plays, but only about a tenth of the time when
+	// not
+	hot := map[bool]int{}
+	const runs = 200
+	for seed := int64(1); seed <= runs; seed++ {
+		for _, byPlays := range []bool{true, false} {
+			if ps.Sample(1, byPlays, seed)[0].Tracks[0].Name == "hot" {
+				hot[byPlays]++
+			}
+		}
+	}
+	if hot[true] < runs*9/10 {
+		t.Errorf("weighted sampling picked the hot track %d of %d times", hot[true], runs)
+	}
+	if hot[false] > runs/3 {
+		t.Errorf("unweighted sampling picked the hot track %d of %d times", hot[false], runs)
+	}
+}
+
+func TestGroupByDecade(t *testing.T) {
+	ps := Playlists{
+		{Name: "One", Tracks: []Track{{Name: "a", Year: 1995}, {Name: "b"}}},
+		{Name: "Two", Tracks: []Track{{Name: "c", Year: 1987}, {Name: "d", Year: 1980}, {Name: "e", Year: 1999}}},
+	}
+	got := ps.GroupByDecade()
+	if names := playlistNames(got); !reflect.DeepEqual(names, []string{"1980s", "1990s", "Unknown"}) {
+		t.Fatalf("sections = %q", names)
+	}
+	want := [][]string{{"c", "d"}, {"a", "e"}, {"b"}}
+	for i, p := range got {
+		if names := trackNames(p); !reflect.DeepEqual(names, want[i]) {
+			t.Errorf("%s = %q, want %q", p.Name, names, want[i])
+		}
+	}
+}
+
+func TestSamplePlaylists(t *testing.T) {
+	var ps Playlists
+	for i := 0; i < 20; i++ {
+		ps = append(ps, Playlist{Name: fmt.Sprintf("P%02d", i)})
+	}
+	first := playlistNames(ps.SamplePlaylists(5, 7))
+	if len(first) != 5 {
+		t.Fatalf("got %d playlists, want 5", len(first))
+	}
+	if !sort.StringsAreSorted(first) {
+		t.Errorf("sample %q isn't in the original order", first)
+	}
+	if again := playlistNames(ps.SamplePlaylists(5, 7)); !reflect.DeepEqual(again, first) {
+		t.Errorf("same seed gave %q then %q", first, again)
+	}
+	if other := playlistNames(ps.SamplePlaylists(5, 8)); reflect.DeepEqual(other, first) {
+		t.Errorf("different seeds both gave %q", first)
+	}
+	if all := ps.SamplePlaylists(50, 7); len(all) != len(ps) {
+		t.Errorf("asking for more than there are gave %d playlists, want all %d", len(all), len(ps))
+	}
+}
+
+func TestBPM(t *testing.T) {
+	ps := Playlists{{Name: "Set", Tracks: []Track{
+		{Name: "dnb", BPM: 174},
+		{Name: "none"},
+		{Name: "house", BPM: 120},
+	}}}
+
+	sorted := Playlists{{Name: "Set", Tracks: append([]Track(nil), ps[0].Tracks...)}}
+	sorted[0].Sort("bpm")
+	if got := trackNames(sorted[0]); !reflect.DeepEqual(got, []string{"none", "house", "dnb"}) {
+		t.Errorf("sorted by BPM = %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		min, max int
+		want     []string
+	}{
+		{"range", 100, 130, []string{"house"}},
+		{"min only", 150, 0, []string{"dnb"}},
+		{"max only", 0, 200, []string{"dnb", "house"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ps.FilterByBPM(tt.min, tt.max)
+			if len(got) != 1 || !reflect.DeepEqual(trackNames(got[0]), tt.want) {
+				t.Errorf("FilterByBPM(%d, %d) = %v, want %q", tt.min, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	a := Track{Artist: "A", Album: "X", Name: "1", Year: 2001}
+	b := Track{Artist: "A", Album: "X", Name: "1", Year: 1999}
+	c := Track{Artist: "B", Album: "W", Name: "2"}
+	one := Playlists{
+		{Name: "Zed", Tracks: []Track{c, a, b}},
+		{Name: "Alpha", Tracks: []Track{b, c}},
+	}
+	two := Playlists{
+		{Name: "Alpha", Tracks: []Track{c, b}},
+		{Name: "Zed", Tracks: []Track{b, c, a}},
+	}
+	one.Canonicalize()
+	two.Canonicalize()
+	if !reflect.DeepEqual(one, two) {
+		t.Errorf("the same library in a different order canonicalized to\n%v\nand\n%v", one, two)
+	}
+	want := []Track{b, a, c}
+	if !reflect.DeepEqual(one[1].Tracks, want) || one[0].Name != "Alpha" {
+		t.Errorf("got %v, want Alpha first and Zed's tracks as %v", one, want)
+	}
+}
@@ -0,0 +1,847 @@
+// Package itunes parses iTunes library XML exports into playlists of tracks,
+// and filters, sorts, and writes those playlists out in various formats.
+package itunes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotLibrary is returned by Parse when the XML is a valid plist but doesn't
+// have the structure of an iTunes library export.
+var ErrNotLibrary = errors.New("does not appear to be an iTunes library export")
+
+// Kinds of Warning raised while parsing.
+const (
+	WarnNoTracks      = "no-tracks"
+	WarnMixedTrackIDs = "mixed-track-ids"
+	WarnMissingTrack  = "missing-track"
+	WarnBadTrackID    = "bad-track-id"
+	WarnBadLocation   = "bad-location"
+)
+
+// Warning records a problem encountered during the run that didn't stop the
+// playlists being written, such as a skipped playlist or truncated output.
+type Warning struct {
+	Kind     string `json:"kind"`
+	Playlist string `json:"playlist,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (w Warning) String() string {
+	if w.Playlist == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("Playlist %s: %s", w.Playlist, w.Message)
+}
+
+// Options control how Parse converts a library into playlists. The zero value
+// gives the default behaviour.
+type Options struct {
+	// KeepBuiltin keeps the playlists iTunes creates itself, such as Library,
+	// Music, and Podcasts, which are skipped by default.
+	KeepBuiltin bool
+	// IncludeEmpty keeps playlists that have no tracks at all, rather than
+	// dropping them, so that they still appear in the output.
+	IncludeEmpty bool
+	// EmptyIsValue keeps empty string values as they are rather than
+	// replacing them with the 'Unknown ...' defaults.
+	EmptyIsValue bool
+	// KeyField is the track field the musical key is read from. It defaults
+	// to "Grouping".
+	KeyField string
+	// Flatten leaves playlists in folders named as they are and keeps the
+	// folders themselves as playlists. By default folders are skipped and
+	// the playlists in them are named by their folder path, e.g.
+	// "Folder > Subfolder > Playlist".
+	Flatten bool
+	// SkipMissing drops playlist entries whose track isn't in the library
+	// without warning. By default they are kept as "Unknown" tracks with
+	// their Track ID and a Warning is raised for each.
+	SkipMissing bool
+	// AllTracks ignores the playlists and returns every track in the library
+	// in a single "All Tracks" playlist, ordered by Track ID.
+	AllTracks bool
+	// RelativePaths makes track locations relative to the library's Music
+	// Folder. Tracks stored outside the Music Folder keep their absolute
+	// location. Only the Location written out is relative: MissingFiles still
+	// checks the absolute path.
+	RelativePaths bool
+	// Normalize tidies up track artists, albums, and names: surrounding
+	// whitespace is trimmed, non-breaking spaces become ordinary spaces, and
+	// typographic quotes are folded to their ASCII equivalents.
+	Normalize bool
+	// Defaulted, if set, is called with the name of the field, such as
+	// "Album", each time a track is missing a field and is given a default
+	// such as "Unknown Album" instead.
+	Defaulted func(field string)
+	// Warn, if set, is called with each Warning raised while parsing.
+	Warn func(Warning)
+	// Debugf, if set, is called with progress messages while parsing.
+	Debugf func(format string, args ...interface{})
+}
+
+func (o Options) warn(kind, playlist, msg string) {
+	if o.Warn != nil {
+		o.Warn(Warning{Kind: kind, Playlist: playlist, Message: msg})
+	}
+}
+
+func (o Options) debugf(format string, args ...interface{}) {
+	if o.Debugf != nil {
+		o.Debugf(format, args...)
+	}
+}
+
+// str is StringOrDefault, except that empty strings are kept if EmptyIsValue
+// is set.
+func (o Options) str(val interface{}, alt string) string {
+	if s, ok := val.(string); ok && o.EmptyIsValue {
+		return s
+	}
+	return StringOrDefault(val, alt)
+}
+
+// normalizedFields are the track fields tidied up by Normalize.
+var normalizedFields = map[string]bool{"Artist": true, "Album": true, "Name": true}
+
+// trackField is str for a track's string field, except that the string is
+// normalized first if Normalize applies to the field, so that names which are
+// only whitespace get the default too. Defaulted is told about the field if
+// it falls back on a non-empty default.
+func (o Options) trackField(td Dict, key, alt string) string {
+	val := td.KVs[key]
+	if s, ok := val.(string); ok && o.Normalize && normalizedFields[key] {
+		val = normalize(s)
+	}
+	s := o.str(val, alt)
+	if s == alt && alt != "" && o.Defaulted != nil && StringOrDefault(val, "") != alt {
+		o.Defaulted(key)
+	}
+	return s
+}
+
+// normalizeReplacer folds typographic quotes to ASCII and non-breaking
+// spaces to ordinary ones.
+var normalizeReplacer = strings.NewReplacer(
+	"\u2018", "'", "\u2019", "'", "\u201a", "'", "\u201b", "'",
+	"\u201c", `"`, "\u201d", `"`, "\u201e", `"`, "\u201f", `"`,
+	"\u00a0", " ", "\u202f", " ",
+)
+
+// normalize trims surrounding whitespace from s and folds the typographic
+// quotes and non-breaking spaces that names copied from web stores often
+// contain.
+func normalize(s string) string {
+	return strings.TrimSpace(normalizeReplacer.Replace(s))
+}
+
+type Track struct {
+	ID           int64  `json:"id,omitempty"`
+	PersistentID string `json:"persistent_id,omitempty"`
+	Artist       string `json:"artist"`
+	Album        string `json:"album"`
+	AlbumArtist  string `json:"album_artist"`
+	Name         string `json:"name"`
+	Genre        string `json:"genre"`
+	Grouping     string `json:"grouping,omitempty"`
+	Composer     string `json:"composer"`
+	Comments     string `json:"comments,omitempty"`
+	Year         int    `json:"year,omitempty"`
+	DiscNumber   int    `json:"disc_number,omitempty"`
+	TrackNumber  int    `json:"track_number,omitempty"`
+	PlayCount    int    `json:"play_count,omitempty"`
+	Rating       int    `json:"rating,omitempty"`
+	BPM          int    `json:"bpm,omitempty"`
+	Key          string `json:"key,omitempty"`
+	Duration     int64  `json:"duration,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Location     string `json:"location,omitempty"`
+	// path is the absolute location of the track's file, for when Location
+	// has been made relative to the Music Folder
+	path         string
+	DateAdded    Timestamp `json:"date_added"`
+	DateModified Timestamp `json:"date_modified"`
+	PlayDate     Timestamp `json:"play_date"`
+}
+
+// Timestamp is a track date. It marshals to JSON as null rather than as
+// 0001-01-01 when the track has no such date, as the date columns do.
+type Timestamp struct {
+	time.Time
+}
+
+func (ts Timestamp) MarshalJSON() ([]byte, error) {
+	if ts.IsZero() {
+		return []byte("null"), nil
+	}
+	return ts.Time.MarshalJSON()
+}
+
+type Playlist struct {
+	Name string `json:"name"`
+	// IsSmart is set for smart playlists, whose tracks iTunes picks by a set
+	// of rules rather than by hand.
+	IsSmart bool    `json:"smart,omitempty"`
+	Tracks  []Track `json:"tracks"`
+}
+
+type Playlists []Playlist
+
+type Album struct {
+	Artist string
+	Name   string
+	Year   int
+}
+
+type LibraryStats struct {
+	Tracks    int
+	Playlists int
+	Artists   int
+	Albums    int
+	TotalTime int64 // milliseconds
+	TotalSize int64 // bytes, counting each track once
+}
+
+// Parse reads an iTunes library XML export from r and converts it into its
+// playlists, using the default Options.
+func Parse(r io.Reader) (Playlists, error) {
+	return ParseWithOptions(r, Options{})
+}
+
+// ParseWithOptions reads an iTunes library XML export from r and converts it
+// into its playlists. The XML is decoded straight from the reader rather than
+// being read into memory first, as libraries can run to hundreds of megabytes.
+// An error wrapping ErrNotLibrary is returned if the XML doesn't look like
+// an iTunes library.
+func ParseWithOptions(r io.Reader, opts Options) (Playlists, error) {
+	lib, err := ParseLibrary(r)
+	if err != nil {
+		return nil, err
+	}
+	keyField := opts.KeyField
+	if keyField == "" {
+		keyField = "Grouping"
+	}
+
+	// Extract the tracks as a helpful object
+	// Check the file actually looks like an iTunes library before digging in
+	rawTracks, ok := lib.D.KVs["Tracks"].(Dict)
+	if !ok {
+		return nil, fmt.Errorf("%w: no Tracks dict found", ErrNotLibrary)
+	}
+	var musicFolder string
+	if opts.RelativePaths {
+		folder, err := locationPath(StringOrDefault(lib.D.KVs["Music Folder"], ""))
+		switch {
+		case err != nil:
+			opts.debugf("Library's Music Folder is invalid, so track locations are left absolute: %s", err)
+		case folder == "":
+			opts.debugf("Library has no Music Folder, so track locations are left absolute")
+		case !strings.HasSuffix(folder, "/"):
+			musicFolder = folder + "/"
+		default:
+			musicFolder = folder
+		}
+	}
+	tracks, err := opts.convertTracks(rawTracks, keyField, musicFolder)
+	if err != nil {
+		return nil, err
+	}
+	opts.debugf("Library contains %d tracks", len(tracks))
+
+	if opts.AllTracks {
+		return Playlists{{Name: "All Tracks", Tracks: sortedTracks(tracks)}}, nil
+	}
+
+	rawPlaylists, ok := lib.D.KVs["Playlists"].(Array)
+	if !ok {
+		return nil, fmt.Errorf("%w: no Playlists array found", ErrNotLibrary)
+	}
+	playlistDicts := rawPlaylists.Dicts()
+	opts.debugf("Library contains %d playlists", len(playlistDicts))
+
+	// Folders are playlists too, and any playlist can name one as its parent,
+	// so index them all by persistent ID before working out folder paths
+	folders := make(map[string]playlistFolder)
+	for _, d := range playlistDicts {
+		if id := StringOrDefault(d.KVs["Playlist Persistent ID"], ""); id != "" {
+			folders[id] = playlistFolder{
+				name:     opts.str(d.KVs["Name"], "Unknown Playlist"),
+				parentID: StringOrDefault(d.KVs["Parent Persistent ID"], ""),
+			}
+		}
+	}
+
+	// Convert the playlists into something useful, losing the enormous
+	// built-in 'Library', 'Downloaded', 'Music', 'Podcasts' etc. playlists
+	// unless they've been asked for.
+	var playlists Playlists
+	for _, d := range playlistDicts {
+		var p Playlist
+		p.Name = opts.str(d.KVs["Name"], "Unknown Playlist")
+		p.IsSmart = isSmartPlaylist(d)
+		if !opts.KeepBuiltin && isBuiltinPlaylist(d) {
+			opts.debugf("Skipping built-in playlist %s", p.Name)
+			continue
+		}
+		if !opts.Flatten {
+			// A folder's items are just the tracks of the playlists in it,
+			// which are listed under their own names
+			if BoolOrDefault(d.KVs["Folder"], false) {
+				opts.debugf("Skipping folder %s", p.Name)
+				continue
+			}
+			p.Name = folderPath(p.Name, StringOrDefault(d.KVs["Parent Persistent ID"], ""), folders)
+		}
+		pTracks, ok := d.KVs["Playlist Items"].(Array)
+		if !ok {
+			opts.warn(WarnNoTracks, p.Name, "playlist has no tracks")
+			if opts.IncludeEmpty {
+				p.Tracks = []Track{}
+				playlists = append(playlists, p)
+			}
+			continue
+		}
+		// Some exports store Track IDs as strings rather than integers, so
+		// accept both, but keep count as a mix of the two is a sign of an odd
+		// export
+		var intIDs, stringIDs int
+		for _, t := range pTracks.Dicts() {
+			var trackID string
+			switch id := t.KVs["Track ID"].(type) {
+			case int64:
+				trackID = strconv.FormatInt(id, 10)
+				intIDs++
+			case string:
+				n, err := strconv.Atoi(strings.TrimSpace(id))
+				if err != nil {
+					opts.warn(WarnBadTrackID, p.Name, fmt.Sprintf("skipping item with invalid Track ID %q", id))
+					continue
+				}
+				trackID = strconv.Itoa(n)
+				stringIDs++
+			default:
+				opts.warn(WarnBadTrackID, p.Name, "skipping item with no Track ID")
+				continue
+			}
+			tk, ok := tracks[trackID]
+			if !ok {
+				if opts.SkipMissing {
+					opts.debugf("Skipping missing track %s in playlist %s", trackID, p.Name)
+					continue
+				}
+				opts.warn(WarnMissingTrack, p.Name, fmt.Sprintf("track %s is not in the library", trackID))
+				tk = missingTrack(trackID, keyField)
+			}
+			p.Tracks = append(p.Tracks, tk)
+		}
+		if intIDs > 0 && stringIDs > 0 {
+			opts.warn(WarnMixedTrackIDs, p.Name, fmt.Sprintf("mixed Track ID types (%d integer, %d string)", intIDs, stringIDs))
+		}
+		playlists = append(playlists, p)
+	}
+
+	opts.debugf("Parsed %d playlists successfully", len(playlists))
+	return playlists, nil
+}
+
+// convertTracks converts the library's track dicts, keyed by Track ID, into
+// Tracks. Each track converts independently of the others, so large libraries
+// are split between a worker per CPU; libraries too small to be worth
+// splitting are converted in a simple loop.
+func (o Options) convertTracks(rawTracks Dict, keyField, musicFolder string) (map[string]Track, error) {
+	workers := runtime.GOMAXPROCS(0)
+	if n := len(rawTracks.KVs); n < minTracksPerWorker*workers {
+		workers = n/minTracksPerWorker + 1
+	}
+	if workers == 1 {
+		return o.convertTracksSerial(rawTracks, keyField, musicFolder)
+	}
+	return o.convertTracksParallel(rawTracks, keyField, musicFolder, workers)
+}
+
+// minTracksPerWorker keeps small libraries from being split between more
+// workers than are worth starting.
+const minTracksPerWorker = 1000
+
+// convertTracksSerial converts the track dicts one after another.
+func (o Options) convertTracksSerial(rawTracks Dict, keyField, musicFolder string) (map[string]Track, error) {
+	tracks := make(map[string]Track, len(rawTracks.KVs))
+	for trackID, trackDict := range rawTracks.KVs {
+		td, ok := trackDict.(Dict)
+		if !ok {
+			return nil, fmt.Errorf("%w: track %s is not a dict", ErrNotLibrary, trackID)
+		}
+		tracks[trackID] = o.convertTrack(trackID, td, keyField, musicFolder)
+	}
+	return tracks, nil
+}
+
+// convertTracksParallel splits the track dicts evenly between the given
+// number of workers, each filling its own map, and merges the maps at the
+// end. The Options callbacks are only ever called by one worker at a time.
+func (o Options) convertTracksParallel(rawTracks Dict, keyField, musicFolder string, workers int) (map[string]Track, error) {
+	var mu sync.Mutex
+	if warn := o.Warn; warn != nil {
+		o.Warn = func(w Warning) {
+			mu.Lock()
+			defer mu.Unlock()
+			warn(w)
+		}
+	}
+	if defaulted := o.Defaulted; defaulted != nil {
+		o.Defaulted = func(field string) {
+			mu.Lock()
+			defer mu.Unlock()
+			defaulted(field)
+		}
+	}
+
+	ids := make([]string, 0, len(rawTracks.KVs))
+	for id := range rawTracks.KVs {
+		ids = append(ids, id)
+	}
+	share := (len(ids) + workers - 1) / workers
+	shards := make([]map[string]Track, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		start, end := i*share, (i+1)*share
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if start > end {
+			start = end
+		}
+		shards[i] = make(map[string]Track, end-start)
+		wg.Add(1)
+		go func(i int, ids []string) {
+			defer wg.Done()
+			for _, id := range ids {
+				td, ok := rawTracks.KVs[id].(Dict)
+				if !ok {
+					errs[i] = fmt.Errorf("%w: track %s is not a dict", ErrNotLibrary, id)
+					return
+				}
+				shards[i][id] = o.convertTrack(id, td, keyField, musicFolder)
+			}
+		}(i, ids[start:end])
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	tracks := shards[0]
+	for _, shard := range shards[1:] {
+		for id, t := range shard {
+			tracks[id] = t
+		}
+	}
+	return tracks, nil
+}
+
+// convertTrack converts a single track dict, stored under trackID in the
+// library, into a Track.
+func (o Options) convertTrack(trackID string, td Dict, keyField, musicFolder string) Track {
+	var t Track
+	// The track's own Track ID should match its key in the Tracks dict,
+	// but fall back on the key for exports that leave it out
+	id, _ := strconv.ParseInt(trackID, 10, 64)
+	t.ID = Int64OrDefault(td.KVs["Track ID"], id)
+	t.PersistentID = StringOrDefault(td.KVs["Persistent ID"], "")
+	t.Artist = o.trackField(td, "Artist", "Unknown Artist")
+	t.Album = o.trackField(td, "Album", "Unknown Album")
+	t.AlbumArtist = o.trackField(td, "Album Artist", t.Artist)
+	t.Name = o.trackField(td, "Name", "Unknown Name")
+	t.Genre = o.trackField(td, "Genre", "Unknown Genre")
+	t.Grouping = o.trackField(td, "Grouping", "")
+	t.Composer = o.trackField(td, "Composer", "Unknown Composer")
+	t.Comments = o.trackField(td, "Comments", "")
+	t.Year = IntOrDefault(td.KVs["Year"], 0)
+	t.DiscNumber = IntOrDefault(td.KVs["Disc Number"], 0)
+	t.TrackNumber = IntOrDefault(td.KVs["Track Number"], 0)
+	t.PlayCount = IntOrDefault(td.KVs["Play Count"], 0)
+	t.Rating = IntOrDefault(td.KVs["Rating"], 0)
+	t.BPM = IntOrDefault(td.KVs["BPM"], 0)
+	t.Key = o.trackField(td, keyField, "")
+	t.Duration = Int64OrDefault(td.KVs["Total Time"], 0)
+	t.Size = Int64OrDefault(td.KVs["Size"], 0)
+	loc, err := locationPath(StringOrDefault(td.KVs["Location"], ""))
+	if err != nil {
+		o.warn(WarnBadLocation, "", fmt.Sprintf("track %s has an invalid Location: %s", trackID, err))
+	}
+	t.Location = loc
+	if musicFolder != "" && strings.HasPrefix(t.Location, musicFolder) {
+		t.path = t.Location
+		t.Location = strings.TrimPrefix(t.Location, musicFolder)
+	}
+	t.DateAdded = Timestamp{TimeOrDefault(td.KVs["Date Added"], time.Time{})}
+	t.DateModified = Timestamp{TimeOrDefault(td.KVs["Date Modified"], time.Time{})}
+	t.PlayDate = Timestamp{TimeOrDefault(td.KVs["Play Date UTC"], time.Time{})}
+	return t
+}
+
+// missingTrack returns the placeholder kept for a playlist entry whose track
+// isn't in the library, so that it shows up as an "Unknown" row with its
+// Track ID rather than a blank one. It isn't counted for --report-missing.
+func missingTrack(trackID, keyField string) Track {
+	return Options{}.convertTrack(trackID, Dict{}, keyField, "")
+}
+
+// sortedTracks returns the tracks ordered numerically by their Track ID, so
+// that the order doesn't depend on map iteration. Any IDs that aren't numbers
+// sort after those that are, in string order.
+func sortedTracks(tracks map[string]Track) []Track {
+	ids := make([]string, 0, len(tracks))
+	for id := range tracks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, errA := strconv.Atoi(ids[i])
+		b, errB := strconv.Atoi(ids[j])
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil || errB == nil:
+			return errA == nil
+		default:
+			return ids[i] < ids[j]
+		}
+	})
+	out := make([]Track, len(ids))
+	for i, id := range ids {
+		out[i] = tracks[id]
+	}
+	return out
+}
+
+// isBuiltinPlaylist reports whether the playlist dict is one of the playlists
+// iTunes creates itself: the master 'Library' playlist, or one of the special
+// 'Downloaded', 'Music', 'Podcasts', etc. playlists which carry a
+// 'Distinguished Kind'.
+func isBuiltinPlaylist(d Dict) bool {
+	if BoolOrDefault(d.KVs["Master"], false) {
+		return true
+	}
+	_, distinguished := d.KVs["Distinguished Kind"]
+	return distinguished
+}
+
+// isSmartPlaylist reports whether the playlist dict is a smart playlist. The
+// rules themselves are stored in an undocumented binary format, so only their
+// presence is checked.
+func isSmartPlaylist(d Dict) bool {
+	_, info := d.KVs["Smart Info"]
+	_, criteria := d.KVs["Smart Criteria"]
+	return info || criteria
+}
+
+// Merge combines the playlists from several libraries into one set. Playlists
+// with the same name have their tracks concatenated, in the order the
+// libraries are given, and otherwise the playlists keep the order they are
+// first seen in. Repeated tracks are kept; see Dedupe.
+func Merge(libs ...Playlists) Playlists {
+	var out Playlists
+	index := make(map[string]int)
+	for _, lib := range libs {
+		for _, p := range lib {
+			if i, ok := index[p.Name]; ok {
+				out[i].Tracks = append(out[i].Tracks, p.Tracks...)
+				continue
+			}
+			index[p.Name] = len(out)
+			p.Tracks = append(make([]Track, 0, len(p.Tracks)), p.Tracks...)
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// playlistFolder is a playlist folder's name and the persistent ID of the
+// folder it's in, if any.
+type playlistFolder struct {
+	name     string
+	parentID string
+}
+
+// folderPath prefixes the playlist name with the names of the folders it's
+// in, outermost first and separated by " > ". Unknown parents end the path,
+// as does a folder that turns out to be inside itself.
+func folderPath(name, parentID string, folders map[string]playlistFolder) string {
+	seen := make(map[string]bool)
+	for parentID != "" && !seen[parentID] {
+		seen[parentID] = true
+		f, ok := folders[parentID]
+		if !ok {
+			break
+		}
+		name = f.name + " > " + name
+		parentID = f.parentID
+	}
+	return name
+}
+
+// locationPath converts a track's Location, which iTunes stores as a file://
+// URL, into a filesystem path with decodeLocation. Anything that isn't a file
+// URL is returned unchanged, as is a file URL that can't be decoded, along
+// with the error.
+func locationPath(loc string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(loc), "file:") {
+		return loc, nil
+	}
+	path, err := decodeLocation(loc)
+	if err != nil {
+		return loc, err
+	}
+	return path, nil
+}
+
+// decodeLocation parses a file:// URL and decodes it into a filesystem path,
+// undoing the percent-encoding of spaces and other characters. Windows drive
+// letters lose the leading slash the URL gives them, so file:///C:/Music
+// becomes C:/Music, and a host other than localhost gives a network path, so
+// file://server/share becomes //server/share. Paths keep forward slashes on
+// every platform.
+func decodeLocation(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(u.Scheme, "file") {
+		return "", fmt.Errorf("%q is not a file URL", uri)
+	}
+	if u.Opaque != "" {
+		return "", fmt.Errorf("file URL %q has no path", uri)
+	}
+	path := u.Path
+	switch {
+	case u.Host == "" || strings.EqualFold(u.Host, "localhost"):
+	case isDriveLetter(u.Host):
+		// Some exports leave out the empty host: file://C:/Music
+		path = u.Host + path
+	default:
+		path = "//" + u.Host + path
+	}
+	if len(path) >= 3 && path[0] == '/' && isDriveLetter(path[1:3]) {
+		path = path[1:]
+	}
+	if path == "" {
+		return "", fmt.Errorf("file URL %q has no path", uri)
+	}
+	return path, nil
+}
+
+// isDriveLetter reports whether s is a Windows drive letter, such as "C:".
+func isDriveLetter(s string) bool {
+	return len(s) == 2 && s[1] == ':' && ('a' <= s[0] && s[0] <= 'z' || 'A' <= s[0] && s[0] <= 'Z')
+}
+
+// TrackCount returns the total number of tracks across all the playlists.
+func (ps Playlists) TrackCount() int {
+	n := 0
+	for _, p := range ps {
+		n += len(p.Tracks)
+	}
+	return n
+}
+
+// Head returns a copy of the playlists truncated to at most n tracks in total.
+// Playlists that would be left with no tracks are dropped.
+func (ps Playlists) Head(n int) Playlists {
+	var out Playlists
+	for _, p := range ps {
+		if n <= 0 {
+			break
+		}
+		if len(p.Tracks) > n {
+			p.Tracks = p.Tracks[:n]
+		}
+		n -= len(p.Tracks)
+		out = append(out, p)
+	}
+	return out
+}
+
+// Stats summarises the playlists: the number of tracks and playlists, the
+// number of distinct artists and albums, the combined running time of every
+// track, and the size of their files. Tracks in several playlists only count
+// towards the size once.
+func (ps Playlists) Stats() LibraryStats {
+	artists := make(map[string]bool)
+	albums := make(map[[2]string]bool)
+	sized := make(map[int64]bool)
+	var s LibraryStats
+	s.Playlists = len(ps)
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			s.Tracks++
+			s.TotalTime += t.Duration
+			artists[t.Artist] = true
+			albums[[2]string{t.Artist, t.Album}] = true
+			if !sized[t.ID] {
+				sized[t.ID] = true
+				s.TotalSize += t.Size
+			}
+		}
+	}
+	s.Artists = len(artists)
+	s.Albums = len(albums)
+	return s
+}
+
+// DupEntry is a song, identified by artist and name, that appears in more
+// than one playlist.
+type DupEntry struct {
+	Artist string
+	Name   string
+	// Playlists are the names of the playlists the song appears in, in
+	// playlist order. A playlist is only listed once however many times the
+	// song appears in it.
+	Playlists []string
+}
+
+// CrossPlaylistDuplicates finds the songs that appear in more than one of the
+// playlists, matching tracks by artist and name. The songs in the most
+// playlists come first, with ties ordered by artist and then name. The
+// playlists themselves are left unchanged.
+func (ps Playlists) CrossPlaylistDuplicates() []DupEntry {
+	type songKey struct{ artist, name string }
+	var songs []songKey
+	playlists := make(map[songKey][]string)
+	for _, p := range ps {
+		seen := make(map[songKey]bool)
+		for _, t := range p.Tracks {
+			k := songKey{t.Artist, t.Name}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			if _, ok := playlists[k]; !ok {
+				songs = append(songs, k)
+			}
+			playlists[k] = append(playlists[k], p.Name)
+		}
+	}
+
+	var dups []DupEntry
+	for _, k := range songs {
+		if len(playlists[k]) > 1 {
+			dups = append(dups, DupEntry{Artist: k.artist, Name: k.name, Playlists: playlists[k]})
+		}
+	}
+	sort.SliceStable(dups, func(i, j int) bool {
+		if len(dups[i].Playlists) != len(dups[j].Playlists) {
+			return len(dups[i].Playlists) > len(dups[j].Playlists)
+		}
+		if dups[i].Artist != dups[j].Artist {
+			return dups[i].Artist < dups[j].Artist
+		}
+		return dups[i].Name < dups[j].Name
+	})
+	return dups
+}
+
+// MissingFile is a track whose file location doesn't exist on disk, along
+// with the playlist it was found in.
+type MissingFile struct {
+	Playlist string
+	Track    Track
+	// Path is the file that was found to be missing. It is the track's
+	// absolute location even when Location is relative to the Music Folder.
+	Path string
+}
+
+// filePath returns the absolute location of the track's file, or Location if
+// it was never made relative.
+func (t Track) filePath() string {
+	if t.path != "" {
+		return t.path
+	}
+	return t.Location
+}
+
+// MissingFiles checks that the file behind every track with a location still
+// exists, and returns the tracks whose files are missing in playlist order.
+// Tracks without a location are skipped. Each location is only checked once,
+// however many playlists it appears in.
+func (ps Playlists) MissingFiles() []MissingFile {
+	exists := make(map[string]bool)
+	var missing []MissingFile
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			path := t.filePath()
+			if path == "" {
+				continue
+			}
+			ok, checked := exists[path]
+			if !checked {
+				_, err := os.Stat(path)
+				ok = err == nil
+				exists[path] = ok
+			}
+			if !ok {
+				missing = append(missing, MissingFile{Playlist: p.Name, Track: t, Path: path})
+			}
+		}
+	}
+	return missing
+}
+
+// variousArtists is the artist given to an album whose tracks have differing
+// artists when albums are keyed on the album name alone.
+const variousArtists = "Various Artists"
+
+// Discography returns the distinct albums across all the playlists, sorted by
+// artist, then year, then album name. An album that appears in several
+// playlists is only listed once. By default albums are identified by artist,
+// album name, and year; if albumOnly is set they are identified by the album
+// name alone, so that compilations with a different artist on every track are
+// kept together under "Various Artists".
+func (ps Playlists) Discography(albumOnly bool) []Album {
+	seen := make(map[Album]int)
+	var albums []Album
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			a := Album{Artist: t.Artist, Name: t.Album, Year: t.Year}
+			key := a
+			if albumOnly {
+				key = Album{Name: t.Album}
+			}
+			i, ok := seen[key]
+			if !ok {
+				seen[key] = len(albums)
+				albums = append(albums, a)
+				continue
+			}
+			if albums[i].Artist != a.Artist {
+				albums[i].Artist = variousArtists
+			}
+			if albums[i].Year == 0 {
+				albums[i].Year = a.Year
+			}
+		}
+	}
+	sort.Slice(albums, func(i, j int) bool {
+		if albums[i].Artist != albums[j].Artist {
+			return albums[i].Artist < albums[j].Artist
+		}
+		if albums[i].Year != albums[j].Year {
+			return albums[i].Year < albums[j].Year
+		}
+		return albums[i].Name < albums[j].Name
+	})
+	return albums
+}
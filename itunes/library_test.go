@@ -0,0 +1,516 @@
+package itunes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// libraryXML builds a library export from the given plist XML for the
+// entries of the Tracks dict and the Playlists array.
+func libraryXML(tracks, playlists string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>Tracks</key><dict>` + tracks + `</dict>
+<key>Playlists</key><array>` + playlists + `</array>
+</dict></plist>`
+}
+
+// parseXML parses a library built by libraryXML, failing the test on error.
+func parseXML(t *testing.T, tracks, playlists string, opts Options) Playlists {
+	t.Helper()
+	ps, err := ParseWithOptions(strings.NewReader(libraryXML(tracks, playlists)), opts)
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	return ps
+}
+
+func TestParseMissingTrack(t *testing.T) {
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer><key>Name</key><string>Found</string></dict>`
+	playlists := `<dict><key>Name</key><string>P</string><key>Playlist Items</key><array>
+<dict><key>Track ID</key><integer>1</integer></dict>
+<dict><key>Track ID</key><integer>999</integer></dict>
+</array></dict>`
+	tests := []struct {
+		name         string
+		skip         bool
+		wantNames    []string
+		wantWarnings int
+	}{
+		{"kept as unknown", false, []string{"Found", "Unknown Name"}, 1},
+		{"skipped", true, []string{"Found"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var warned, defaulted int
+			ps := parseXML(t, tracks, playlists, Options{
+				SkipMissing: tt.skip,
+				Warn:        func(Warning) { warned++ },
+				Defaulted:   func(string) { defaulted++ },
+			})
+			var names []string
+			for _, tk := range ps[0].Tracks {
+				names = append(names, tk.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantNames, ",") {
+				t.Errorf("tracks = %q, want %q", names, tt.wantNames)
+			}
+			if warned != tt.wantWarnings {
+				t.Errorf("got %d warnings, want %d", warned, tt.wantWarnings)
+			}
+			if !tt.skip {
+				missing := ps[0].Tracks[1]
+				if missing.ID != 999 || missing.Artist != "Unknown Artist" {
+					t.Errorf("missing track = %+v, want ID 999 and Unknown Artist", missing)
+				}
+			}
+			// Only the found track's defaults count: Artist, Album, Album
+			// Artist, Genre, and Composer
+			if defaulted != 5 {
+				t.Errorf("got %d defaulted fields, want 5", defaulted)
+			}
+		})
+	}
+}
+
+func TestDecodeLocation(t *testing.T) {
+	tests := []struct {
+		name, uri, want string
+		wantErr         bool
+	}{
+		{"posix", "file:///Users/a/Music/b%20c.mp3", "/Users/a/Music/b c.mp3", false},
+		{"localhost", "file://localhost/Music/a.mp3", "/Music/a.mp3", false},
+		{"drive letter", "file:///C:/Music/a.mp3", "C:/Music/a.mp3", false},
+		{"drive letter as host", "file://C:/Music/a.mp3", "C:/Music/a.mp3", false},
+		{"unc", "file://server/share/a.mp3", "//server/share/a.mp3", false},
+		{"not a file url", "http://example.com/a.mp3", "", true},
+		{"no path", "file:", "", true},
+		{"bad escape", "file:///a%zz.mp3", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeLocation(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeLocation(%q) error = %v, want error %v", tt.uri, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("decodeLocation(%q) = %q, want %q", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+// benchmarkTracks builds a Tracks dict of n tracks with the fields a typical
+// export has.
+func benchmarkTracks(n int) Dict {
+	d := Dict{KVs: make(map[string]interface{}, n)}
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		d.KVs[id] = Dict{KVs: map[string]interface{}{
+			"Track ID":   int64(i),
+			"Name":       "Track " + id,
+			"Artist":     "Artist " + strconv.Itoa(i%500),
+			"Album":      "Album " + strconv.Itoa(i%2000),
+			"Genre":      "Rock",
+			"Year":       int64(1970 + i%50),
+			"Play Count": int64(i % 40),
+			"Total Time": int64(200000),
+			"Size":       int64(8000000),
+			"Location":   "file:///Users/a/Music/Artist/Album/" + id + "%20Track.m4a",
+			"Date Added": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		}}
+	}
+	return d
+}
+
+// BenchmarkConvertTracksSerial and BenchmarkConvertTracksParallel compare
+// the two ways of converting a large library. The parallel version uses a
+// worker per CPU, so run them with e.g. -cpu 1,4 to see how it scales.
+func BenchmarkConvertTracksSerial(b *testing.B) {
+	raw := benchmarkTracks(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := (Options{}).convertTracksSerial(raw, "Grouping", ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConvertTracksParallel(b *testing.B) {
+	raw := benchmarkTracks(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := (Options{}).convertTracksParallel(raw, "Grouping", "", runtime.GOMAXPROCS(0)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestConvertTracksParallel(t *testing.T) {
+	raw := benchmarkTracks(5000)
+	raw.KVs["bad"] = "not a dict"
+	for _, workers := range []int{2, 3, 7} {
+		if _, err := (Options{}).convertTracksParallel(raw, "Grouping", "", workers); !errors.Is(err, ErrNotLibrary) {
+			t.Errorf("%d workers: err = %v, want ErrNotLibrary", workers, err)
+		}
+	}
+	delete(raw.KVs, "bad")
+	var defaulted int
+	opts := Options{Defaulted: func(string) { defaulted++ }}
+	want, err := opts.convertTracksSerial(raw, "Grouping", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialDefaulted := defaulted
+	for _, workers := range []int{2, 3, 7} {
+		defaulted = 0
+		got, err := opts.convertTracksParallel(raw, "Grouping", "", workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers converted the tracks differently", workers)
+		}
+		if defaulted != serialDefaulted {
+			t.Errorf("%d workers reported %d defaults, want %d", workers, defaulted, serialDefaulted)
+		}
+	}
+}
+
+// benchmarkLibraryXML builds a library export of n tracks, all in a single
+// playlist.
+func benchmarkLibraryXML(n int) string {
+	var tracks, items strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&tracks, `
+<key>%[1]d</key><dict>
+	<key>Track ID</key><integer>%[1]d</integer>
+	<key>Name</key><string>Track %[1]d</string>
+	<key>Artist</key><string>Artist %[2]d</string>
+	<key>Album</key><string>Album %[3]d</string>
+	<key>Genre</key><string>Rock</string>
+	<key>Size</key><integer>8000000</integer>
+	<key>Total Time</key><integer>200000</integer>
+	<key>Year</key><integer>1990</integer>
+	<key>Date Added</key><date>2020-01-01T00:00:00Z</date>
+	<key>Loved</key><true/>
+	<key>Location</key><string>file:///Users/a/Music/Track%%20%[1]d.m4a</string>
+</dict>`, i, i%500, i%2000)
+		fmt.Fprintf(&items, `<dict><key>Track ID</key><integer>%d</integer></dict>`, i)
+	}
+	return libraryXML(tracks.String(), `<dict><key>Name</key><string>All</string><key>Playlist Items</key><array>`+items.String()+`</array></dict>`)
+}
+
+func BenchmarkParse(b *testing.B) {
+	doc := benchmarkLibraryXML(20000)
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Parse decodes from the reader as it goes, just as it would from
+		// an open file
+		if _, err := Parse(strings.NewReader(doc)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"left single quote", "‘Til Tuesday", "'Til Tuesday"},
+		{"right single quote", "Don’t Stop", "Don't Stop"},
+		{"low single quote", "‚a", "'a"},
+		{"reversed single quote", "‛a", "'a"},
+		{"left double quote", "“Hi", `"Hi`},
+		{"right double quote", "Hi”", `Hi"`},
+		{"low double quote", "„Hi", `"Hi`},
+		{"reversed double quote", "‟Hi", `"Hi`},
+		{"non-breaking space", "Sigur\u00a0Rós", "Sigur Rós"},
+		{"narrow non-breaking space", "A\u202fB", "A B"},
+		{"surrounding whitespace", " \t Name \n", "Name"},
+		{"surrounding non-breaking space", "\u00a0Name\u00a0", "Name"},
+		{"unchanged", "Plain 'ASCII' \"name\"", "Plain 'ASCII' \"name\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalize(tt.in); got != tt.want {
+				t.Errorf("normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNormalize(t *testing.T) {
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer>
+<key>Name</key><string> Don’t Stop </string><key>Artist</key><string>  </string>
+<key>Genre</key><string> Rock </string></dict>`
+	playlists := `<dict><key>Name</key><string>P</string><key>Playlist Items</key><array>
+<dict><key>Track ID</key><integer>1</integer></dict></array></dict>`
+	got := parseXML(t, tracks, playlists, Options{Normalize: true})[0].Tracks[0]
+	if got.Name != "Don't Stop" {
+		t.Errorf("Name = %q, want normalized", got.Name)
+	}
+	if got.Artist != "Unknown Artist" {
+		t.Errorf("whitespace-only Artist = %q, want the default", got.Artist)
+	}
+	if got.Genre != " Rock " {
+		t.Errorf("Genre = %q, want it left alone", got.Genre)
+	}
+}
+
+func TestParseLargeSize(t *testing.T) {
+	// 5 GB overflows a 32-bit int, so would wrap if it went through one
+	const size = 5 << 30
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer><key>Size</key><integer>5368709120</integer></dict>`
+	ps := parseXML(t, tracks, "", Options{AllTracks: true})
+	if got := ps[0].Tracks[0].Size; got != size {
+		t.Errorf("Size = %d, want %d", got, int64(size))
+	}
+	if got := int32(ps[0].Tracks[0].Size); int64(got) == size {
+		t.Fatalf("test size %d fits in 32 bits, so can't catch an overflow", int64(size))
+	}
+}
+
+func TestHead(t *testing.T) {
+	ps := Playlists{
+		{Name: "One", Tracks: []Track{{Name: "a"}, {Name: "b"}}},
+		{Name: "Two", Tracks: []Track{{Name: "c"}, {Name: "d"}}},
+		{Name: "Three", Tracks: []Track{{Name: "e"}}},
+	}
+	tests := []struct {
+		n         int
+		wantNames []string
+		wantCount int
+	}{
+		{0, nil, 0},
+		{1, []string{"One"}, 1},
+		{3, []string{"One", "Two"}, 3},
+		{10, []string{"One", "Two", "Three"}, 5},
+	}
+	for _, tt := range tests {
+		got := ps.Head(tt.n)
+		if names := playlistNames(got); !reflect.DeepEqual(names, tt.wantNames) || got.TrackCount() != tt.wantCount {
+			t.Errorf("Head(%d) = %q with %d tracks, want %q with %d", tt.n, names, got.TrackCount(), tt.wantNames, tt.wantCount)
+		}
+	}
+	if len(ps[0].Tracks) != 2 {
+		t.Errorf("Head changed the original playlists")
+	}
+}
+
+func TestParsePersistentID(t *testing.T) {
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer><key>Persistent ID</key><string>0123456789ABCDEF</string></dict>
+<key>2</key><dict><key>Track ID</key><integer>2</integer></dict>`
+	playlists := `<dict><key>Name</key><string>P</string><key>Playlist Items</key><array>
+<dict><key>Track ID</key><integer>1</integer></dict>
+<dict><key>Track ID</key><integer>2</integer></dict>
+</array></dict>`
+	ps := parseXML(t, tracks, playlists, Options{})
+	if got := []string{ps[0].Tracks[0].PersistentID, ps[0].Tracks[1].PersistentID}; !reflect.DeepEqual(got, []string{"0123456789ABCDEF", ""}) {
+		t.Errorf("persistent IDs = %q", got)
+	}
+}
+
+func TestParseEmptyStrings(t *testing.T) {
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer>
+<key>Album</key><string/><key>Artist</key><string></string><key>Name</key><string>N</string></dict>`
+	tests := []struct {
+		name                  string
+		emptyIsValue          bool
+		wantAlbum, wantArtist string
+	}{
+		{"default", false, "Unknown Album", "Unknown Artist"},
+		{"empty is value", true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseXML(t, tracks, "", Options{AllTracks: true, EmptyIsValue: tt.emptyIsValue})[0].Tracks[0]
+			if got.Album != tt.wantAlbum {
+				t.Errorf("self-closing Album = %q, want %q", got.Album, tt.wantAlbum)
+			}
+			if got.Artist != tt.wantArtist {
+				t.Errorf("empty Artist = %q, want %q", got.Artist, tt.wantArtist)
+			}
+			if got.Name != "N" {
+				t.Errorf("Name = %q, want N", got.Name)
+			}
+		})
+	}
+}
+
+func TestDiscographyAlbumKey(t *testing.T) {
+	ps := Playlists{{Name: "P", Tracks: []Track{
+		{Artist: "Coolio", Album: "Now 32", Year: 1995, Name: "Gangsta's Paradise"},
+		{Artist: "Oasis", Album: "Now 32", Name: "Wonderwall"},
+		{Artist: "Oasis", Album: "Morning Glory", Year: 1995, Name: "Champagne Supernova"},
+	}}}
+	tests := []struct {
+		name      string
+		albumOnly bool
+		want      []Album
+	}{
+		{"artist and album", false, []Album{
+			{Artist: "Coolio", Name: "Now 32", Year: 1995},
+			{Artist: "Oasis", Name: "Now 32"},
+			{Artist: "Oasis", Name: "Morning Glory", Year: 1995},
+		}},
+		{"album only", true, []Album{
+			{Artist: "Oasis", Name: "Morning Glory", Year: 1995},
+			{Artist: "Various Artists", Name: "Now 32", Year: 1995},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ps.Discography(tt.albumOnly); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrackIDTypes(t *testing.T) {
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer></dict>
+<key>2</key><dict><key>Track ID</key><integer>2</integer></dict>`
+	playlist := func(name, items string) string {
+		return `<dict><key>Name</key><string>` + name + `</string><key>Playlist Items</key><array>` + items + `</array></dict>`
+	}
+	intItem := `<dict><key>Track ID</key><integer>1</integer></dict>`
+	stringItem := `<dict><key>Track ID</key><string> 2 </string></dict>`
+	badItem := `<dict><key>Track ID</key><string>two</string></dict>`
+	tests := []struct {
+		name       string
+		items      string
+		wantTracks int
+		wantKinds  []string
+	}{
+		{"integers", intItem + intItem, 2, nil},
+		{"strings", stringItem, 1, nil},
+		{"mixed", intItem + stringItem, 2, []string{WarnMixedTrackIDs}},
+		{"invalid string", intItem + badItem, 1, []string{WarnBadTrackID}},
+		{"no Track ID", `<dict><key>Name</key><string>x</string></dict>`, 0, []string{WarnBadTrackID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var kinds []string
+			ps := parseXML(t, tracks, playlist("P", tt.items), Options{
+				IncludeEmpty: true,
+				Warn: func(w Warning) {
+					kinds = append(kinds, w.Kind)
+					if w.Playlist != "P" {
+						t.Errorf("warning %q not tied to the playlist", w)
+					}
+				},
+			})
+			if n := ps.TrackCount(); n != tt.wantTracks {
+				t.Errorf("got %d tracks, want %d", n, tt.wantTracks)
+			}
+			if !reflect.DeepEqual(kinds, tt.wantKinds) {
+				t.Errorf("warnings = %q, want %q", kinds, tt.wantKinds)
+			}
+		})
+	}
+}
+
+func TestParseKeyField(t *testing.T) {
+	tracks := `<key>1</key><dict><key>Track ID</key><integer>1</integer>
+<key>Grouping</key><string>8A</string><key>Comments</key><string>Key: 11B</string></dict>
+<key>2</key><dict><key>Track ID</key><integer>2</integer></dict>`
+	tests := []struct {
+		keyField string
+		want     []string
+	}{
+		{"", []string{"8A", ""}},
+		{"Grouping", []string{"8A", ""}},
+		{"Comments", []string{"Key: 11B", ""}},
+	}
+	for _, tt := range tests {
+		t.Run("key field "+tt.keyField, func(t *testing.T) {
+			ps := parseXML(t, tracks, "", Options{AllTracks: true, KeyField: tt.keyField})
+			var keys []string
+			for _, tk := range ps[0].Tracks {
+				keys = append(keys, tk.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("keys = %q, want %q", keys, tt.want)
+			}
+		})
+	}
+
+	// The key shows up in the output as its own column
+	ps := parseXML(t, tracks, "", Options{AllTracks: true})
+	var buf bytes.Buffer
+	if err := ps.WriteCSV(&buf, CSVOptions{Columns: mustColumns("name", "key")}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Unknown Name,8A\n") {
+		t.Errorf("CSV is missing the key:\n%s", buf.String())
+	}
+
+	// Tracks with no key sort first
+	ps[0].Sort("key")
+	if ps[0].Tracks[0].ID != 2 || ps[0].Tracks[1].Key != "8A" {
+		t.Errorf("sorted by key = %+v", ps[0].Tracks)
+	}
+}
+
+func TestParseRelativePaths(t *testing.T) {
+	music := filepath.ToSlash(t.TempDir())
+	if err := os.WriteFile(music+"/found.mp3", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.ToSlash(t.TempDir()) + "/outside.mp3"
+	if err := os.WriteFile(outside, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	track := func(id, loc string) string {
+		return `<key>` + id + `</key><dict><key>Track ID</key><integer>` + id + `</integer>` +
+			`<key>Name</key><string>T` + id + `</string><key>Location</key><string>` + loc + `</string></dict>`
+	}
+	tracks := track("1", "file://"+music+"/found.mp3") +
+		track("2", "file://"+music+"/gone.mp3") +
+		track("3", "file://"+outside)
+	playlists := `<dict><key>Name</key><string>P</string><key>Playlist Items</key><array>
+<dict><key>Track ID</key><integer>1</integer></dict>
+<dict><key>Track ID</key><integer>2</integer></dict>
+<dict><key>Track ID</key><integer>3</integer></dict>
+</array></dict>`
+	xml := strings.Replace(libraryXML(tracks, playlists), "<dict>\n<key>Tracks</key>",
+		"<dict>\n<key>Music Folder</key><string>file://"+music+"/</string>\n<key>Tracks</key>", 1)
+	ps, err := ParseWithOptions(strings.NewReader(xml), Options{RelativePaths: true})
+	if err != nil {
+		t.Fatalf("ParseWithOptions: %v", err)
+	}
+	var got []string
+	for _, tr := range ps[0].Tracks {
+		got = append(got, tr.Location)
+	}
+	if want := []string{"found.mp3", "gone.mp3", outside}; !reflect.DeepEqual(got, want) {
+		t.Errorf("locations = %q, want %q", got, want)
+	}
+
+	// The relative locations must not be resolved against the working
+	// directory when checking for missing files.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	missing := ps.MissingFiles()
+	if len(missing) != 1 || missing[0].Track.Name != "T2" || missing[0].Path != music+"/gone.mp3" {
+		t.Errorf("MissingFiles = %+v, want only T2 at %s/gone.mp3", missing, music)
+	}
+}
@@ -0,0 +1,265 @@
+package itunes
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type Dict struct {
+	XMLName xml.Name `xml:"dict"`
+	KVs     map[string]interface{}
+}
+
+// Array is a plist array. Its values are decoded the same way as those of a
+// Dict, so may be of mixed types.
+type Array struct {
+	XMLName xml.Name `xml:"array"`
+	Values  []interface{}
+}
+
+// Dicts returns the dict values in the array, in order, skipping any values
+// of other types.
+func (a Array) Dicts() []Dict {
+	var dicts []Dict
+	for _, v := range a.Values {
+		if d, ok := v.(Dict); ok {
+			dicts = append(dicts, d)
+		}
+	}
+	return dicts
+}
+
+func (di *Dict) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	kvs := make(map[string]interface{})
+	// Loop through all the tokens in this element until we find a closing element
+	// that matches our start element
+	var key string
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch ty := t.(type) {
+		case xml.EndElement:
+			if ty.Name.Local == start.Name.Local {
+				// We're done
+				di.KVs = kvs
+				return nil
+			}
+		case xml.StartElement:
+			if ty.Name.Local == "key" {
+				// We're parsing a key
+				var k string
+				if err := d.DecodeElement(&k, &ty); err != nil {
+					return err
+				}
+				key = k
+				continue
+			}
+			v, ok, err := decodeValue(d, ty)
+			if err != nil {
+				return err
+			}
+			if ok {
+				kvs[key] = v
+			}
+		}
+	}
+}
+
+func (a *Array) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	values := []interface{}{}
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch ty := t.(type) {
+		case xml.EndElement:
+			if ty.Name.Local == start.Name.Local {
+				a.Values = values
+				return nil
+			}
+		case xml.StartElement:
+			v, ok, err := decodeValue(d, ty)
+			if err != nil {
+				return err
+			}
+			if ok {
+				values = append(values, v)
+			}
+		}
+	}
+}
+
+// decodeValue decodes the plist value that starts with the given element.
+// ok is false, and nothing is consumed, if the element isn't a known type.
+func decodeValue(d *xml.Decoder, ty xml.StartElement) (v interface{}, ok bool, err error) {
+	switch ty.Name.Local {
+	case "integer":
+		// We're parsing an integer value. These are always decoded as
+		// int64, as file sizes over 2 GB and Mac epoch timestamps would
+		// overflow an int on 32-bit builds.
+		var i int64
+		if err := d.DecodeElement(&i, &ty); err != nil {
+			return nil, false, err
+		}
+		return i, true, nil
+	case "string":
+		// We're parsing a string value
+		var s string
+		if err := d.DecodeElement(&s, &ty); err != nil {
+			return nil, false, err
+		}
+		return s, true, nil
+	case "dict":
+		// We're parsing a nested dict value
+		var di Dict
+		if err := d.DecodeElement(&di, &ty); err != nil {
+			return nil, false, err
+		}
+		return di, true, nil
+	case "array":
+		var a Array
+		if err := d.DecodeElement(&a, &ty); err != nil {
+			return nil, false, err
+		}
+		return a, true, nil
+	case "data":
+		// We're parsing a data value, stored as base64 that's usually
+		// wrapped over several lines
+		var s string
+		if err := d.DecodeElement(&s, &ty); err != nil {
+			return nil, false, err
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+		if err != nil {
+			return nil, false, err
+		}
+		return b, true, nil
+	case "real":
+		// We're parsing a floating point value
+		var f float64
+		if err := d.DecodeElement(&f, &ty); err != nil {
+			return nil, false, err
+		}
+		return f, true, nil
+	case "date":
+		// We're parsing a date value, stored as an RFC 3339 timestamp
+		var s string
+		if err := d.DecodeElement(&s, &ty); err != nil {
+			return nil, false, err
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+		if err != nil {
+			return nil, false, err
+		}
+		return t, true, nil
+	case "true", "false":
+		// We're parsing a boolean value. These are empty elements where the
+		// element name itself is the value, so there's nothing to decode;
+		// just consume the element.
+		if err := d.Skip(); err != nil {
+			return nil, false, err
+		}
+		return ty.Name.Local == "true", true, nil
+	}
+	return nil, false, nil
+}
+
+type ITunesLib struct {
+	XMLName xml.Name `xml:"plist"`
+	D       Dict     `xml:"dict"`
+}
+
+// lineReader counts the lines the XML decoder has read, so that errors in
+// values, such as an integer that isn't a number, can say where they are as
+// XML syntax errors do.
+type lineReader struct {
+	*bufio.Reader
+	line int
+}
+
+func (r *lineReader) ReadByte() (byte, error) {
+	b, err := r.Reader.ReadByte()
+	if err == nil && b == '\n' {
+		r.line++
+	}
+	return b, err
+}
+
+// ParseLibrary decodes a plist XML document into its raw dicts, without
+// interpreting it as an iTunes library. Malformed XML is returned as an error
+// giving the line it was found on.
+func ParseLibrary(r io.Reader) (*ITunesLib, error) {
+	var lib ITunesLib
+	lr := &lineReader{Reader: bufio.NewReader(r), line: 1}
+	if err := xml.NewDecoder(lr).Decode(&lib); err != nil {
+		var syntaxErr *xml.SyntaxError
+		if errors.As(err, &syntaxErr) || err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("line %d: %w", lr.line, err)
+	}
+	return &lib, nil
+}
+
+// StringOrDefault returns val as a string, or alt if val is not a string.
+// Empty strings (from both <string></string> and <string/>) are also replaced
+// by alt.
+func StringOrDefault(val interface{}, alt string) string {
+	s, ok := val.(string)
+	if !ok || s == "" {
+		return alt
+	}
+	return s
+}
+
+// IntOrDefault returns val as an int, or alt if val is not an integer. It's
+// meant for values that are known to be small, such as years and play counts.
+func IntOrDefault(val interface{}, alt int) int {
+	switch i := val.(type) {
+	case int64:
+		return int(i)
+	case int:
+		return i
+	}
+	return alt
+}
+
+// Int64OrDefault returns val as an int64, or alt if val is not an integer.
+// Integers are decoded as int64, but an int is accepted too for dicts built
+// by hand.
+func Int64OrDefault(val interface{}, alt int64) int64 {
+	switch i := val.(type) {
+	case int64:
+		return i
+	case int:
+		return int64(i)
+	}
+	return alt
+}
+
+// TimeOrDefault returns val as a time.Time, or alt if val is not a date.
+func TimeOrDefault(val interface{}, alt time.Time) time.Time {
+	t, ok := val.(time.Time)
+	if !ok {
+		return alt
+	}
+	return t
+}
+
+// BoolOrDefault returns val as a bool, or alt if val is not a bool.
+func BoolOrDefault(val interface{}, alt bool) bool {
+	b, ok := val.(bool)
+	if !ok {
+		return alt
+	}
+	return b
+}
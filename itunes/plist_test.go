@@ -0,0 +1,155 @@
+package itunes
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// plistHeader opens a plist's top-level dict, leaving the body to start on
+// line 2.
+const plistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>`
+
+// parsePlist parses body as the contents of a plist's top-level dict.
+func parsePlist(body string) (*ITunesLib, error) {
+	return ParseLibrary(strings.NewReader(plistHeader + body + `</dict></plist>`))
+}
+
+func TestParseLibraryValues(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want interface{}
+	}{
+		{"integer", `<key>v</key><integer>42</integer>`, int64(42)},
+		{"negative integer", `<key>v</key><integer>-7</integer>`, int64(-7)},
+		{"integer over 2^31", `<key>v</key><integer>3221225472</integer>`, int64(3221225472)},
+		{"real", `<key>v</key><real>0.5</real>`, 0.5},
+		{"string", `<key>v</key><string>Tom &amp; Jerry</string>`, "Tom & Jerry"},
+		{"empty string", `<key>v</key><string/>`, ""},
+		{"date", `<key>v</key><date>2019-03-02T10:11:12Z</date>`, time.Date(2019, 3, 2, 10, 11, 12, 0, time.UTC)},
+		{"true", `<key>v</key><true/>`, true},
+		{"false", `<key>v</key><false/>`, false},
+		{"data", "<key>v</key><data>\n\taGVsbG8g\n\td29ybGQ=\n</data>", []byte("hello world")},
+		{"nested dict", `<key>v</key><dict><key>a</key><dict><key>b</key><integer>1</integer></dict></dict>`,
+			Dict{KVs: map[string]interface{}{"a": Dict{KVs: map[string]interface{}{"b": int64(1)}}}}},
+		{"array of dicts", `<key>v</key><array><dict><key>a</key><integer>1</integer></dict><dict><key>a</key><integer>2</integer></dict></array>`,
+			Array{Values: []interface{}{
+				Dict{KVs: map[string]interface{}{"a": int64(1)}},
+				Dict{KVs: map[string]interface{}{"a": int64(2)}},
+			}}},
+		{"mixed array", `<key>v</key><array><string>a</string><integer>1</integer><true/></array>`,
+			Array{Values: []interface{}{"a", int64(1), true}}},
+		{"empty array", `<key>v</key><array/>`, Array{Values: []interface{}{}}},
+		{"comments and whitespace", "\n\t<!-- before the key -->\n\t<key>v</key>\n\t<!-- between -->\n\t<integer>5</integer>\n\t<!-- after -->\n", int64(5)},
+		{"unknown element skipped", `<key>v</key><integer>1</integer><key>w</key><unknown>x</unknown>`, int64(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lib, err := parsePlist(tt.body)
+			if err != nil {
+				t.Fatalf("ParseLibrary: %v", err)
+			}
+			got := lib.D.KVs["v"]
+			if !reflect.DeepEqual(stripXMLNames(got), tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// stripXMLNames clears the XMLName fields that decoding fills in, so that
+// decoded dicts and arrays can be compared with ones built by hand.
+func stripXMLNames(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Dict:
+		kvs := make(map[string]interface{}, len(v.KVs))
+		for k, x := range v.KVs {
+			kvs[k] = stripXMLNames(x)
+		}
+		return Dict{KVs: kvs}
+	case Array:
+		values := make([]interface{}, len(v.Values))
+		for i, x := range v.Values {
+			values[i] = stripXMLNames(x)
+		}
+		return Array{Values: values}
+	}
+	return v
+}
+
+func TestParseLibraryBools(t *testing.T) {
+	// Each bool is stored under the key before it, even when several run
+	// together
+	lib, err := parsePlist(`<key>a</key><true/><key>b</key><false/><key>c</key><true></true>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"a": true, "b": false, "c": true}
+	if !reflect.DeepEqual(lib.D.KVs, want) {
+		t.Errorf("got %v, want %v", lib.D.KVs, want)
+	}
+}
+
+func TestParseLibraryErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		wantLine string
+		wantErr  string
+	}{
+		{"mismatched tag", plistHeader + "<key>a</key>\n<string>x</integer></dict></plist>", "line 3", "closed by </integer>"},
+		{"unclosed dict", plistHeader + "<key>a</key>\n<dict><key>b</key></plist>", "line 3", "closed by </plist>"},
+		{"truncated", plistHeader + "<key>a</key>\n<dict><key>b</key>\n<string>x", "line 4", "unexpected EOF"},
+		{"truncated in tag", plistHeader + "\n\n<key>a</ke", "line 4", "unexpected EOF"},
+		{"bad integer", plistHeader + "<key>a</key>\n\n<integer>ten</integer></dict></plist>", "line 4", "invalid syntax"},
+		{"bad real", plistHeader + "<key>a</key>\n<real>half</real></dict></plist>", "line 3", "invalid syntax"},
+		{"bad date", plistHeader + "<key>a</key>\n<date>yesterday</date></dict></plist>", "line 3", "cannot parse"},
+		{"bad data", plistHeader + "<key>a</key>\n<data>!!!</data></dict></plist>", "line 3", "illegal base64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseLibrary(strings.NewReader(tt.doc))
+			if err == nil {
+				t.Fatal("ParseLibrary succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantLine) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q should mention %q and %q", err, tt.wantLine, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInt64OrDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		val  interface{}
+		want int64
+	}{
+		{"int64 over 2^31", int64(1) << 33, 1 << 33},
+		{"int64 over 2^32", int64(4294967296 + 5), 4294967301},
+		{"int", 12, 12},
+		{"string", "12", -1},
+		{"missing", nil, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Int64OrDefault(tt.val, -1); got != tt.want {
+				t.Errorf("Int64OrDefault(%#v) = %d, want %d", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLibraryLargeIntegerRoundTrip(t *testing.T) {
+	const big = 1<<40 + 3
+	lib, err := parsePlist(`<key>v</key><integer>1099511627779</integer>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Int64OrDefault(lib.D.KVs["v"], 0); got != big {
+		t.Errorf("got %d, want %d", got, int64(big))
+	}
+}
@@ -0,0 +1,112 @@
+// Package sqliteout writes playlists to SQLite databases. It is kept apart
+// from the itunes package so that programs which only parse libraries don't
+// pull in the database driver.
+package sqliteout
+
+import (
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes"
+	// Registers the CGO-free "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables written by Write. Tracks get their own
+// row id, as merged libraries can reuse the same Track ID for different
+// tracks; track_id is the Track ID from the library. Playlist positions start
+// at 1.
+const sqliteSchema = `
+CREATE TABLE tracks (
+	id           INTEGER PRIMARY KEY,
+	track_id     INTEGER,
+	artist       TEXT,
+	album        TEXT,
+	album_artist TEXT,
+	name         TEXT,
+	genre        TEXT,
+	grouping     TEXT,
+	year         INTEGER,
+	play_count   INTEGER,
+	rating       INTEGER,
+	bpm          INTEGER,
+	musical_key  TEXT,
+	duration_ms  INTEGER,
+	location     TEXT,
+	date_added   TEXT
+);
+CREATE TABLE playlists (
+	id   INTEGER PRIMARY KEY,
+	name TEXT
+);
+CREATE TABLE playlist_tracks (
+	playlist_id INTEGER REFERENCES playlists (id),
+	track_id    INTEGER REFERENCES tracks (id),
+	position    INTEGER
+);
+`
+
+// Write writes the playlists to a new SQLite database at path, replacing
+// any file already there. Each distinct track is stored once in the tracks
+// table, and playlist_tracks joins them to the playlists in playlist order.
+// Tracks from merged libraries that share a Track ID but differ otherwise get
+// a row each. Everything is inserted in a single transaction. An error is
+// returned if the database can't be written.
+func Write(path string, ps itunes.Playlists) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insertTrack, err := tx.Prepare(`INSERT INTO tracks VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	insertPlaylist, err := tx.Prepare(`INSERT INTO playlists (id, name) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	insertItem, err := tx.Prepare(`INSERT INTO playlist_tracks (playlist_id, track_id, position) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	rowIDs := make(map[itunes.Track]int)
+	for i, p := range ps {
+		playlistID := i + 1
+		if _, err := insertPlaylist.Exec(playlistID, p.Name); err != nil {
+			return err
+		}
+		for j, t := range p.Tracks {
+			rowID, ok := rowIDs[t]
+			if !ok {
+				rowID = len(rowIDs) + 1
+				rowIDs[t] = rowID
+				var dateAdded interface{}
+				if !t.DateAdded.IsZero() {
+					dateAdded = t.DateAdded.Format(time.RFC3339)
+				}
+				if _, err := insertTrack.Exec(rowID, t.ID, t.Artist, t.Album, t.AlbumArtist, t.Name, t.Genre, t.Grouping,
+					t.Year, t.PlayCount, t.Rating, t.BPM, t.Key, t.Duration, t.Location, dateAdded); err != nil {
+					return err
+				}
+			}
+			if _, err := insertItem.Exec(playlistID, rowID, j+1); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,85 @@
+package sqliteout
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playlists.db")
+	shared := itunes.Track{ID: 1, Artist: "A", Name: "Shared"}
+	ps := itunes.Playlists{
+		{Name: "One", Tracks: []itunes.Track{shared, {ID: 2, Artist: "B", Name: "Only"}}},
+		{Name: "Two", Tracks: []itunes.Track{shared}},
+	}
+	// Writing twice checks that the old database is replaced
+	for i := 0; i < 2; i++ {
+		if err := Write(path, ps); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	counts := map[string]int{"tracks": 2, "playlists": 2, "playlist_tracks": 3}
+	for table, want := range counts {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s has %d rows, want %d", table, n, want)
+		}
+	}
+	var name string
+	err = db.QueryRow(`SELECT t.name FROM playlist_tracks pt JOIN tracks t ON t.id = pt.track_id
+		WHERE pt.playlist_id = 1 AND pt.position = 2`).Scan(&name)
+	if err != nil || name != "Only" {
+		t.Errorf("second track of the first playlist = %q, %v, want Only", name, err)
+	}
+}
+
+func TestWriteMergedLibraries(t *testing.T) {
+	// Libraries exported from different machines reuse Track IDs
+	a := itunes.Playlists{{Name: "P1", Tracks: []itunes.Track{{ID: 1, Name: "Alpha"}}}}
+	b := itunes.Playlists{{Name: "P1", Tracks: []itunes.Track{{ID: 1, Name: "Beta"}}}}
+	path := filepath.Join(t.TempDir(), "playlists.db")
+	if err := Write(path, itunes.Merge(a, b)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT p.name, t.name, t.track_id FROM playlist_tracks pt
+		JOIN playlists p ON p.id = pt.playlist_id JOIN tracks t ON t.id = pt.track_id
+		ORDER BY pt.position`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var playlist, name string
+		var trackID int64
+		if err := rows.Scan(&playlist, &name, &trackID); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s/%s/%d", playlist, name, trackID))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"P1/Alpha/1", "P1/Beta/1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,834 @@
+package itunes
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVOptions controls the optional parts of the CSV output.
+type CSVOptions struct {
+	// Columns are the fields written for each track. They default to the
+	// playlist name, artist, album, track, genre, length, play count, and
+	// rating (0-100).
+	Columns []Column
+	// Checksum adds a trailing checksum field to each row (see rowChecksum).
+	Checksum bool
+	// Location adds the track's file location as a field, if it isn't one of
+	// the Columns already.
+	Location bool
+	// Delimiter separates the fields. It defaults to a comma.
+	Delimiter rune
+	// NoHeader leaves out the header row, e.g. when appending to a file.
+	NoHeader bool
+}
+
+// WriteCSV writes the set of playlists to the given writer in CSV format.
+// It writes a header row (unless opts.NoHeader is set) and then a row of the
+// chosen columns for each track, plus a checksum field if asked for in opts.
+// Fields containing the delimiter, quotes, or newlines are quoted as per RFC
+// 4180. An error is returned if any issues are encountered during this
+// process.
+func (ps Playlists) WriteCSV(w io.Writer, opts CSVOptions) error {
+	cols := selectColumns(opts.Columns, opts.Location)
+	delim := opts.Delimiter
+	if delim == 0 {
+		delim = ','
+	}
+	// Write header row. This is written by hand rather than through the CSV
+	// writer, which would quote the headers because of their leading spaces.
+	// Only comma-separated headers have always had those spaces, so leave
+	// them out for other delimiters.
+	sep := string(delim)
+	if delim == ',' {
+		sep += " "
+	}
+	var header []string
+	for _, c := range cols {
+		header = append(header, csvHeader(c.Header, delim))
+	}
+	if opts.Checksum {
+		header = append(header, csvHeader("Checksum", delim))
+	}
+	if !opts.NoHeader {
+		if _, err := w.Write([]byte(strings.Join(header, sep) + "\n")); err != nil {
+			return err
+		}
+	}
+	// Write playlist data, flushing after every row so that each row reaches
+	// the underlying writer in a single write
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			row := make([]string, 0, len(cols)+1)
+			for _, c := range cols {
+				row = append(row, c.CSV(p, t))
+			}
+			if opts.Checksum {
+				row = append(row, rowChecksum(row...))
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// csvHeader quotes a header cell, after RFC 4180, if it contains the delimiter,
+// quotes, or newlines, so that e.g. "Track No." stays one field when the
+// delimiter is a space or a full stop.
+func csvHeader(h string, delim rune) string {
+	if !strings.ContainsRune(h, delim) && !strings.ContainsAny(h, "\"\r\n") {
+		return h
+	}
+	return `"` + strings.ReplaceAll(h, `"`, `""`) + `"`
+}
+
+// csvChecksum returns the rowChecksum of the track's CSV row for the columns.
+func csvChecksum(cols []Column, p Playlist, t Track) string {
+	row := make([]string, len(cols))
+	for i, c := range cols {
+		row[i] = c.CSV(p, t)
+	}
+	return rowChecksum(row...)
+}
+
+// rowChecksum returns the CRC32 of the given field values as 8 hex digits.
+// The fields are joined with the ASCII unit separator first so that moving
+// text between adjacent fields changes the checksum.
+func rowChecksum(fields ...string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(strings.Join(fields, "\x1f"))))
+}
+
+// A Reserver is a writer that can stop taking output part way through, such as
+// one that caps its size. WriteJSON and WriteHTML hold back room on it for the
+// end of the document, so that when the next playlist or track doesn't fit
+// they can still close the document and leave it well-formed.
+type Reserver interface {
+	io.Writer
+	// Reserve holds back room for n bytes after the next write: a write that
+	// would leave less room than that is refused.
+	Reserve(n int)
+}
+
+// docWriter writes a document a piece at a time, keeping hold of what would
+// close the document as written so far. When a piece can't be written to a
+// Reserver, the document is closed before the error is returned.
+type docWriter struct {
+	w       io.Writer
+	closing string
+}
+
+// write writes s, after which the document would be closed by closing.
+func (dw *docWriter) write(s, closing string) error {
+	r, ok := dw.w.(Reserver)
+	if ok {
+		r.Reserve(len(closing))
+	}
+	if _, err := io.WriteString(dw.w, s); err != nil {
+		if ok && dw.closing != "" {
+			r.Reserve(0)
+			io.WriteString(dw.w, dw.closing)
+		}
+		return err
+	}
+	dw.closing = closing
+	return nil
+}
+
+// JSONOptions controls the optional parts of the JSON output.
+type JSONOptions struct {
+	// Columns, if set, limits each track to the given fields, in that order.
+	// By default every field of Track is written.
+	Columns []Column
+	// Compact writes the JSON on one line rather than indented.
+	Compact bool
+	// Checksum adds a checksum field to each track: the rowChecksum of its
+	// CSV row for the same Columns, or for the default columns if none are
+	// set.
+	Checksum bool
+}
+
+// WriteJSON writes the set of playlists to the given writer as a JSON array
+// of playlist objects, each holding its name and array of tracks. Playlists
+// and tracks are written one at a time, so that on a Reserver the output can
+// end early and still be valid JSON. An error is returned if any issues are
+// encountered during this process.
+func (ps Playlists) WriteJSON(w io.Writer, opts JSONOptions) error {
+	// The layout matches what a json.Encoder, indented by two spaces unless
+	// Compact is set, writes for the whole array at once
+	indent := func(depth int) string {
+		if opts.Compact {
+			return ""
+		}
+		return "\n" + strings.Repeat("  ", depth)
+	}
+	colon := ": "
+	if opts.Compact {
+		colon = ":"
+	}
+	marshal := func(v interface{}) ([]byte, error) {
+		if opts.Compact {
+			return json.Marshal(v)
+		}
+		return json.MarshalIndent(v, strings.Repeat("  ", 3), "  ")
+	}
+	// closeArray ends an array at the given depth holding n values. An empty
+	// array is written as [].
+	closeArray := func(depth, n int) string {
+		if n == 0 {
+			return "]"
+		}
+		return indent(depth) + "]"
+	}
+
+	dw := &docWriter{w: w}
+	if err := dw.write("[", closeArray(0, 0)+"\n"); err != nil {
+		return err
+	}
+	for i, p := range ps {
+		name, err := json.Marshal(p.Name)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(indent(1) + "{" + indent(2) + `"name"` + colon + string(name))
+		if p.IsSmart && len(opts.Columns) == 0 {
+			b.WriteString("," + indent(2) + `"smart"` + colon + "true")
+		}
+		b.WriteString("," + indent(2) + `"tracks"` + colon)
+		end := indent(1) + "}"
+		rest := closeArray(0, i+1) + "\n"
+		// Only the full tracks are left as null when a playlist has none;
+		// the columns always have an array
+		if p.Tracks == nil && len(opts.Columns) == 0 {
+			b.WriteString("null" + end)
+			if err := dw.write(b.String(), rest); err != nil {
+				return err
+			}
+			continue
+		}
+		b.WriteString("[")
+		if err := dw.write(b.String(), closeArray(2, 0)+end+rest); err != nil {
+			return err
+		}
+		for j, t := range p.Tracks {
+			var v interface{} = t
+			if len(opts.Columns) > 0 {
+				v = columnRecord{cols: opts.Columns, playlist: p, track: t, checksum: opts.Checksum}
+			} else if opts.Checksum {
+				v = struct {
+					Track
+					Checksum string `json:"checksum"`
+				}{t, csvChecksum(selectColumns(nil, false), p, t)}
+			}
+			val, err := marshal(v)
+			if err != nil {
+				return err
+			}
+			sep := ""
+			if j > 0 {
+				sep = ","
+			}
+			if err := dw.write(sep+indent(3)+string(val), closeArray(2, j+1)+end+rest); err != nil {
+				return err
+			}
+		}
+		if err := dw.write(closeArray(2, len(p.Tracks))+end, rest); err != nil {
+			return err
+		}
+	}
+	return dw.write(closeArray(0, len(ps))+"\n", "")
+}
+
+// WriteNDJSON writes the tracks of every playlist to the given writer as
+// newline-delimited JSON: one object per line holding the playlist name
+// alongside the track's fields. An error is returned if any issues are
+// encountered during this process.
+func (ps Playlists) WriteNDJSON(w io.Writer) error {
+	type line struct {
+		Playlist string `json:"playlist"`
+		Track
+	}
+	enc := json.NewEncoder(w)
+	for _, p := range ps {
+		for _, t := range p.Tracks {
+			if err := enc.Encode(line{Playlist: p.Name, Track: t}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteOutline writes the playlists as a numbered text outline: each playlist
+// is a numbered heading and its tracks are indented, numbered "Artist - Name"
+// items beneath it. Track numbering restarts for each playlist. An error is
+// returned if any issues are encountered while writing.
+func (ps Playlists) WriteOutline(w io.Writer) error {
+	for i, p := range ps {
+		buf := bytes.NewBuffer(nil)
+		fmt.Fprintf(buf, "%d. %s\n", i+1, p.Name)
+		for j, t := range p.Tracks {
+			fmt.Fprintf(buf, "  %d. %s - %s\n", j+1, t.Artist, t.Name)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDiscography writes the distinct albums across all the playlists to the
+// given writer, one "Artist - Album (Year)" line per album. The year is left
+// off for albums that don't have one. See Discography for the meaning of
+// albumOnly. An error is returned if any issues are encountered while writing.
+func (ps Playlists) WriteDiscography(w io.Writer, albumOnly bool) error {
+	for _, a := range ps.Discography(albumOnly) {
+		line := fmt.Sprintf("%s - %s", a.Artist, a.Name)
+		if a.Year != 0 {
+			line += fmt.Sprintf(" (%d)", a.Year)
+		}
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteStats writes the library statistics to the given writer, one labelled
+// value per line.
+func (s LibraryStats) WriteStats(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Tracks:     %d\nPlaylists:  %d\nArtists:    %d\nAlbums:     %d\nTotal time: %s\nTotal size: %s\n",
+		s.Tracks, s.Playlists, s.Artists, s.Albums, formatLongDuration(s.TotalTime), humanSize(s.TotalSize))
+	return err
+}
+
+// WriteMissingFiles writes a report of the given missing files to w, one
+// "Playlist: Artist - Name (path)" line per track. An error is returned if any
+// issues are encountered while writing.
+func WriteMissingFiles(w io.Writer, missing []MissingFile) error {
+	for _, m := range missing {
+		line := fmt.Sprintf("%s: %s - %s (%s)\n", m.Playlist, m.Track.Artist, m.Track.Name, m.Path)
+		if _, err := w.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDuplicates writes a report of the given duplicate songs to w, one
+// "Artist - Name (N playlists): Playlist, Playlist" line per song. An error is
+// returned if any issues are encountered while writing.
+func WriteDuplicates(w io.Writer, dups []DupEntry) error {
+	for _, d := range dups {
+		line := fmt.Sprintf("%s - %s (%d playlists): %s\n", d.Artist, d.Name, len(d.Playlists), strings.Join(d.Playlists, ", "))
+		if _, err := w.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TableOptions controls the optional parts of the table output.
+type TableOptions struct {
+	// Columns are the fields shown for each track. They default to the same
+	// columns as the CSV output.
+	Columns []Column
+	// Location adds a column with each track's file location at the end, if
+	// it isn't one of the Columns already.
+	Location bool
+	// Totals ends each playlist's section with a row giving its number of
+	// tracks and combined running time.
+	Totals bool
+	// Color highlights the table with ANSI escapes for terminals: playlist
+	// names are bold and every other track row is shaded.
+	Color bool
+}
+
+// ANSI escapes used when colouring the table.
+const (
+	ansiBold      = "\x1b[1m"
+	ansiNotBold   = "\x1b[22m"
+	ansiShade     = "\x1b[100m"
+	ansiNoShading = "\x1b[49m"
+)
+
+// WriteTable writes out the playlists data as a human-readable table.
+// The column widths are set to match the widest entry and the columns are
+// padded for readability. See TableOptions for the optional columns and rows.
+// An error is returned in the event of any processing issues.
+func (ps Playlists) WriteTable(w io.Writer, opts TableOptions) error {
+	cols := selectColumns(opts.Columns, opts.Location)
+	colWidths := ps.ColumnWidths(cols)
+	// Pad the calculated widths by 2 so that the table fields have a space at either end.
+	for i := range colWidths {
+		colWidths[i] += 2
+	}
+	// Actually write the table
+	buf := bytes.NewBuffer(nil)
+	// Write the header row
+	writeDividerRow := func() {
+		for _, cw := range colWidths {
+			buf.WriteString("+")
+			buf.WriteString(strings.Repeat("-", cw))
+		}
+		buf.WriteString("+\n")
+	}
+	// Escapes are written around the padded cells rather than inside them,
+	// so colouring doesn't change the width calculations
+	writeRow := func(cells []string, shade, boldPlaylist bool) {
+		if shade {
+			buf.WriteString(ansiShade)
+		}
+		for i := range cells {
+			buf.WriteString("|")
+			bold := boldPlaylist && cols[i].Name == "playlist"
+			if bold {
+				buf.WriteString(ansiBold)
+			}
+			cell := fmt.Sprintf(" %s ", cells[i])
+			buf.WriteString(cell)
+			n := utf8.RuneCountInString(cell)
+			// Right-pad with spaces
+			if n < colWidths[i] {
+				buf.WriteString(strings.Repeat(" ", colWidths[i]-n))
+			}
+			if bold {
+				buf.WriteString(ansiNotBold)
+			}
+		}
+		buf.WriteString("|")
+		if shade {
+			buf.WriteString(ansiNoShading)
+		}
+		buf.WriteString("\n")
+	}
+	// Empty playlists get a row giving their name in place of any tracks. It
+	// spans every column, including the dividers between them, and the last
+	// column is widened if need be so that it fits.
+	tableWidth := len(colWidths) - 1
+	for _, cw := range colWidths {
+		tableWidth += cw
+	}
+	emptyRow := func(p Playlist) string {
+		return fmt.Sprintf(" %s (no tracks) ", p.Name)
+	}
+	for _, p := range ps {
+		if len(p.Tracks) > 0 {
+			continue
+		}
+		if n := utf8.RuneCountInString(emptyRow(p)); n > tableWidth {
+			colWidths[len(colWidths)-1] += n - tableWidth
+			tableWidth = n
+		}
+	}
+	writeSpanningRow := func(cell string) {
+		buf.WriteString("|")
+		buf.WriteString(cell)
+		if n := utf8.RuneCountInString(cell); n < tableWidth {
+			buf.WriteString(strings.Repeat(" ", tableWidth-n))
+		}
+		buf.WriteString("|\n")
+	}
+	// The totals row spans the table in the same way
+	writeTotalsRow := func(p Playlist) {
+		var total int64
+		for _, t := range p.Tracks {
+			total += t.Duration
+		}
+		tracks := "tracks"
+		if len(p.Tracks) == 1 {
+			tracks = "track"
+		}
+		writeSpanningRow(fmt.Sprintf(" %d %s, %s ", len(p.Tracks), tracks, formatLongDuration(total)))
+	}
+	writeDividerRow()
+	colHeaders := make([]string, len(cols))
+	for i, c := range cols {
+		colHeaders[i] = c.Header
+	}
+	writeRow(colHeaders, false, false)
+	writeDividerRow()
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	buf.Reset()
+	// Write Platlist data
+	for _, p := range ps {
+		if len(p.Tracks) == 0 {
+			writeSpanningRow(emptyRow(p))
+		}
+		for j, t := range p.Tracks {
+			colItems := make([]string, len(cols))
+			for i, c := range cols {
+				colItems[i] = c.Text(p, t)
+			}
+			writeRow(colItems, opts.Color && j%2 == 1, opts.Color)
+		}
+		// Finish section
+		writeDividerRow()
+		if opts.Totals {
+			writeTotalsRow(p)
+			writeDividerRow()
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+
+	return nil
+}
+
+// formatDuration renders a duration in milliseconds as minutes and seconds,
+// e.g. 214000 becomes "3:34". An unknown (zero) duration renders as an empty
+// string.
+func formatDuration(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	secs := ms / 1000
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// formatStars renders a 0-100 rating as five star glyphs, filled for each
+// whole star, e.g. 80 becomes "★★★★☆". An unrated (zero) track renders as an
+// empty string.
+func formatStars(rating int) string {
+	if rating <= 0 {
+		return ""
+	}
+	stars := rating / 20
+	if stars > 5 {
+		stars = 5
+	}
+	return strings.Repeat("★", stars) + strings.Repeat("☆", 5-stars)
+}
+
+// formatLongDuration renders a duration in milliseconds as hours, minutes,
+// and seconds, e.g. 10267000 becomes "2:51:07".
+func formatLongDuration(ms int64) string {
+	secs := ms / 1000
+	return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+}
+
+// humanSize renders a size in bytes with decimal units, as the Finder does,
+// e.g. 8400000 becomes "8.4 MB".
+func humanSize(bytes int64) string {
+	if bytes < 1000 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	size := float64(bytes)
+	units := []string{"kB", "MB", "GB", "TB", "PB", "EB"}
+	i := -1
+	// Stop short of 1000 so that rounding can't give "1000.0 kB"
+	for size >= 999.95 && i < len(units)-1 {
+		size /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// playlistFileNameReplacer swaps out characters that aren't safe to use in
+// file names on common filesystems.
+var playlistFileNameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_",
+)
+
+// playlistFileName turns a playlist name into a safe file name with the given
+// extension. Names are compared case-insensitively, as on macOS and Windows,
+// and collisions get a numeric suffix.
+func playlistFileName(name, ext string, used map[string]bool) string {
+	name = playlistFileNameReplacer.Replace(name)
+	fileName := name + ext
+	for i := 2; used[strings.ToLower(fileName)]; i++ {
+		fileName = fmt.Sprintf("%s (%d)%s", name, i, ext)
+	}
+	used[strings.ToLower(fileName)] = true
+	return fileName
+}
+
+// WriteM3U writes each playlist to its own extended M3U file in the given
+// directory, creating the directory if needed. Files are named after the
+// playlist with a .m3u8 extension, as they are UTF-8 encoded. Each track gets
+// an #EXTINF line with its duration in seconds and an "Artist - Name" title,
+// followed by its file path. Tracks with no location can't be played so are
+// left out. An error is returned if any of the files can't be written.
+func (ps Playlists) WriteM3U(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, p := range ps {
+		fileName := playlistFileName(p.Name, ".m3u8", used)
+		buf := bytes.NewBufferString("#EXTM3U\n")
+		for _, t := range p.Tracks {
+			if t.Location == "" {
+				continue
+			}
+			// M3U uses -1 for an unknown duration
+			secs := int64(-1)
+			if t.Duration > 0 {
+				secs = t.Duration / 1000
+			}
+			fmt.Fprintf(buf, "#EXTINF:%d,%s - %s\n%s\n", secs, t.Artist, t.Name, t.Location)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fileName), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePLS writes each playlist to its own PLS file in the given directory,
+// creating the directory if needed. Files are named after the playlist with a
+// .pls extension. Each track gets numbered File, Title ("Artist - Name"), and
+// Length (in seconds, -1 if unknown) entries. As with WriteM3U, tracks with no
+// location are left out. An error is returned if any of the files can't be
+// written.
+func (ps Playlists) WritePLS(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, p := range ps {
+		fileName := playlistFileName(p.Name, ".pls", used)
+		buf := bytes.NewBufferString("[playlist]\n")
+		n := 0
+		for _, t := range p.Tracks {
+			if t.Location == "" {
+				continue
+			}
+			n++
+			secs := int64(-1)
+			if t.Duration > 0 {
+				secs = t.Duration / 1000
+			}
+			fmt.Fprintf(buf, "File%d=%s\nTitle%d=%s - %s\nLength%d=%d\n", n, t.Location, n, t.Artist, t.Name, n, secs)
+		}
+		fmt.Fprintf(buf, "NumberOfEntries=%d\nVersion=2\n", n)
+		if err := ioutil.WriteFile(filepath.Join(dir, fileName), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xspfPlaylist and xspfTrack are the parts of the XSPF format that get
+// written, in the element order given by the spec.
+type xspfPlaylist struct {
+	XMLName   xml.Name `xml:"playlist"`
+	Version   string   `xml:"version,attr"`
+	Namespace string   `xml:"xmlns,attr"`
+	Title     string   `xml:"title"`
+	TrackList struct {
+		Tracks []xspfTrack `xml:"track"`
+	} `xml:"trackList"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location,omitempty"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"`
+}
+
+// locationURI converts a track location back into a URI for XSPF, undoing
+// decodeLocation. POSIX paths and Windows drive letter paths become file:///
+// URIs, network paths such as //server/share become file://server/share, and
+// relative paths are written as relative URIs. An empty location gives an
+// empty URI.
+func locationURI(loc string) string {
+	switch {
+	case loc == "":
+		return ""
+	case strings.HasPrefix(loc, "//"):
+		host := loc[2:]
+		path := ""
+		if i := strings.Index(host, "/"); i >= 0 {
+			host, path = host[:i], host[i:]
+		}
+		return (&url.URL{Scheme: "file", Host: host, Path: path}).String()
+	case strings.HasPrefix(loc, "/"):
+		return (&url.URL{Scheme: "file", Path: loc}).String()
+	case len(loc) >= 2 && isDriveLetter(loc[:2]):
+		return (&url.URL{Scheme: "file", Path: "/" + loc}).String()
+	default:
+		return (&url.URL{Path: loc}).String()
+	}
+}
+
+// WriteXSPF writes each playlist to its own XSPF file in the given
+// directory, creating the directory if needed. Files are named after the
+// playlist with a .xspf extension. Each track's file path is written as a
+// file:// URI, or a relative URI if it's a relative path. Tracks with no
+// location are kept, as XSPF players can look them up by artist and title. An
+// error is returned if any of the files can't be written.
+func (ps Playlists) WriteXSPF(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, p := range ps {
+		fileName := playlistFileName(p.Name, ".xspf", used)
+		doc := xspfPlaylist{Version: "1", Namespace: "http://xspf.org/ns/0/", Title: p.Name}
+		for _, t := range p.Tracks {
+			xt := xspfTrack{Title: t.Name, Creator: t.Artist, Album: t.Album, Duration: t.Duration}
+			xt.Location = locationURI(t.Location)
+			doc.TrackList.Tracks = append(doc.TrackList.Tracks, xt)
+		}
+		buf := bytes.NewBufferString(xml.Header)
+		enc := xml.NewEncoder(buf)
+		enc.Indent("", "  ")
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+		buf.WriteString("\n")
+		if err := ioutil.WriteFile(filepath.Join(dir, fileName), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// htmlTemplate renders the pieces of the standalone HTML document that
+// WriteHTML writes: its head, a table per playlist, and a row per track.
+// html/template takes care of escaping names.
+var htmlTemplate = template.Must(template.New("html").Parse(`
+{{- define "head" -}}
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Playlists</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+caption { font-weight: bold; text-align: left; padding: 0.5em 0; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: left; }
+th { background: #eee; }
+tr:nth-child(even) td { background: #f8f8f8; }
+</style>
+</head>
+<body>
+{{- end}}
+{{- define "table"}}
+<table>
+<caption>{{.Name}}</caption>
+<tr><th>Artist</th><th>Album</th><th>Track</th></tr>
+{{- end}}
+{{- define "row"}}
+<tr><td>{{.Artist}}</td><td>{{.Album}}</td><td>{{.Name}}</td></tr>
+{{- end}}
+`))
+
+// htmlTableEnd and htmlEnd close a playlist's table and the document.
+const (
+	htmlTableEnd = "\n</table>"
+	htmlEnd      = "\n</body>\n</html>\n"
+)
+
+// WriteHTML writes the playlists to the given writer as a complete HTML
+// document, with a table of artist, album, and track per playlist captioned
+// with the playlist name. Playlists and tracks are written one at a time, so
+// that on a Reserver the document can end early and still be complete. An
+// error is returned if any issues are encountered while writing.
+func (ps Playlists) WriteHTML(w io.Writer) error {
+	dw := &docWriter{w: w}
+	var buf bytes.Buffer
+	execute := func(name string, data interface{}) (string, error) {
+		buf.Reset()
+		err := htmlTemplate.ExecuteTemplate(&buf, name, data)
+		return buf.String(), err
+	}
+	head, err := execute("head", nil)
+	if err != nil {
+		return err
+	}
+	if err := dw.write(head, htmlEnd); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		table, err := execute("table", p)
+		if err != nil {
+			return err
+		}
+		if err := dw.write(table, htmlTableEnd+htmlEnd); err != nil {
+			return err
+		}
+		for _, t := range p.Tracks {
+			row, err := execute("row", t)
+			if err != nil {
+				return err
+			}
+			if err := dw.write(row, htmlTableEnd+htmlEnd); err != nil {
+				return err
+			}
+		}
+		if err := dw.write(htmlTableEnd, htmlEnd); err != nil {
+			return err
+		}
+	}
+	return dw.write(htmlEnd, "")
+}
+
+// markdownCellReplacer escapes pipes, which would otherwise end a Markdown
+// table cell early.
+var markdownCellReplacer = strings.NewReplacer("|", `\|`)
+
+// WriteMarkdown writes the playlists to the given writer as GitHub-flavoured
+// Markdown: a "##" heading per playlist followed by a table with the default
+// columns of WriteTable, less the playlist name. An error is returned if any
+// issues are encountered while writing.
+func (ps Playlists) WriteMarkdown(w io.Writer) error {
+	// The playlist name is the heading, so leave out the playlist column
+	cols := mustColumns(defaultColumnNames[1:]...)
+	for i, p := range ps {
+		buf := bytes.NewBuffer(nil)
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(buf, "## %s\n\n", p.Name)
+		headers := make([]string, len(cols))
+		dividers := make([]string, len(cols))
+		for j, c := range cols {
+			headers[j] = c.Header
+			dividers[j] = "---"
+		}
+		fmt.Fprintf(buf, "| %s |\n", strings.Join(headers, " | "))
+		fmt.Fprintf(buf, "| %s |\n", strings.Join(dividers, " | "))
+		for _, t := range p.Tracks {
+			cells := make([]string, len(cols))
+			for j, c := range cols {
+				cells[j] = markdownCellReplacer.Replace(c.Text(p, t))
+			}
+			fmt.Fprintf(buf, "| %s |\n", strings.Join(cells, " | "))
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+package itunes
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestLocationURI(t *testing.T) {
+	tests := []struct {
+		name, loc, want string
+	}{
+		{"empty", "", ""},
+		{"posix", "/Users/a/Music/b c.mp3", "file:///Users/a/Music/b%20c.mp3"},
+		{"drive letter", "C:/Music/b.mp3", "file:///C:/Music/b.mp3"},
+		{"lower case drive letter", "d:/b.mp3", "file:///d:/b.mp3"},
+		{"unc", "//server/share/b.mp3", "file://server/share/b.mp3"},
+		{"unc host only", "//server", "file://server"},
+		{"relative", "Artist/b.mp3", "Artist/b.mp3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := locationURI(tt.loc)
+			if got != tt.want {
+				t.Fatalf("locationURI(%q) = %q, want %q", tt.loc, got, tt.want)
+			}
+			// Absolute locations should decode back to where they started
+			if strings.HasPrefix(got, "file:") {
+				path, err := decodeLocation(got)
+				if err != nil || path != tt.loc {
+					t.Errorf("decodeLocation(%q) = %q, %v, want %q", got, path, err, tt.loc)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteXSPFLocations(t *testing.T) {
+	dir := t.TempDir()
+	ps := Playlists{{Name: "P", Tracks: []Track{
+		{Name: "posix", Location: "/Music/a.mp3"},
+		{Name: "drive", Location: "C:/Music/b.mp3"},
+		{Name: "unc", Location: "//nas/music/c.mp3"},
+		{Name: "none"},
+	}}}
+	if err := ps.WriteXSPF(dir); err != nil {
+		t.Fatalf("WriteXSPF: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "P.xspf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, want := range []string{
+		"<location>file:///Music/a.mp3</location>",
+		"<location>file:///C:/Music/b.mp3</location>",
+		"<location>file://nas/music/c.mp3</location>",
+		"<title>none</title>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Count(out, "<location>") != 3 {
+		t.Errorf("want 3 locations, got:\n%s", out)
+	}
+}
+
+func TestWriteJSONNullDates(t *testing.T) {
+	added := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ps := Playlists{{Name: "P", Tracks: []Track{{Name: "a", DateAdded: Timestamp{added}}}}}
+	write := map[string]func(w io.Writer) error{
+		"json":   func(w io.Writer) error { return ps.WriteJSON(w, JSONOptions{Compact: true}) },
+		"ndjson": ps.WriteNDJSON,
+		"columns": func(w io.Writer) error {
+			cols, err := ParseColumns("name,date_added,date_modified,play_date")
+			if err != nil {
+				return err
+			}
+			return ps.WriteJSON(w, JSONOptions{Columns: cols, Compact: true})
+		},
+	}
+	for name, fn := range write {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := fn(&buf); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if strings.Contains(out, "0001-01-01") {
+				t.Errorf("zero date written as a time: %s", out)
+			}
+			if !strings.Contains(out, "null") || !strings.Contains(out, "2020-01-02") {
+				t.Errorf("want null for the missing dates and the date added kept: %s", out)
+			}
+		})
+	}
+}
+
+func TestWriteJSONMatchesEncoder(t *testing.T) {
+	all := Playlists{
+		{Name: "Smart <&+>", IsSmart: true, Tracks: []Track{{ID: 1, Name: "a"}, {ID: 2, Name: "b\u2028"}}},
+		{Name: "Empty", Tracks: []Track{}},
+		{Name: "Nil"},
+	}
+	cols := mustColumns("artist", "name", "date_added")
+	for _, compact := range []bool{false, true} {
+		for _, ps := range []Playlists{all, all[:1], nil} {
+			var want bytes.Buffer
+			enc := json.NewEncoder(&want)
+			if !compact {
+				enc.SetIndent("", "  ")
+			}
+			if ps == nil {
+				enc.Encode(Playlists{})
+			} else {
+				enc.Encode(ps)
+			}
+			var got bytes.Buffer
+			if err := ps.WriteJSON(&got, JSONOptions{Compact: compact}); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != want.String() {
+				t.Errorf("compact=%v: got\n%s\nwant\n%s", compact, got.String(), want.String())
+			}
+
+			// The columns are encoded as name and tracks only, with an
+			// array for every playlist
+			var records []map[string]interface{}
+			got.Reset()
+			if err := ps.WriteJSON(&got, JSONOptions{Columns: cols, Compact: compact}); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(got.Bytes(), &records); err != nil {
+				t.Fatalf("compact=%v: %v\n%s", compact, err, got.String())
+			}
+			if len(records) != len(ps) {
+				t.Errorf("compact=%v: got %d playlists, want %d", compact, len(records), len(ps))
+			}
+			for _, r := range records {
+				if _, ok := r["tracks"].([]interface{}); !ok || len(r) != 2 {
+					t.Errorf("compact=%v: playlist %v should have a name and a tracks array", compact, r)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteTableMultibyteWidths(t *testing.T) {
+	ps := Playlists{{Name: "Mix", Tracks: []Track{
+		{Artist: "Björk", Album: "Homogenic", Name: "Jóga"},
+		{Artist: "坂本龍一", Album: "B-2 Unit", Name: "Riot in Lagos"},
+		{Artist: "A", Album: "B", Name: "C"},
+	}}}
+	var buf bytes.Buffer
+	if err := ps.WriteTable(&buf, TableOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	divider := utf8.RuneCountInString(lines[0])
+	for _, line := range lines {
+		if n := utf8.RuneCountInString(line); n != divider {
+			t.Errorf("row %q is %d runes, want %d to match the divider", line, n, divider)
+		}
+	}
+}
+
+func TestWriteDiscography(t *testing.T) {
+	ps := Playlists{
+		{Name: "One", Tracks: []Track{
+			{Artist: "Radiohead", Album: "OK Computer", Year: 1997, Name: "Airbag"},
+			{Artist: "Radiohead", Album: "The Bends", Year: 1995, Name: "Fake Plastic Trees"},
+			{Artist: "Radiohead", Album: "OK Computer", Year: 1997, Name: "Lucky"},
+		}},
+		{Name: "Two", Tracks: []Track{
+			{Artist: "Radiohead", Album: "The Bends", Year: 1995, Name: "Just"},
+			{Artist: "Air", Album: "Moon Safari", Name: "La Femme d'Argent"},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := ps.WriteDiscography(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "Air - Moon Safari\nRadiohead - The Bends (1995)\nRadiohead - OK Computer (1997)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteCSVChecksum(t *testing.T) {
+	track := Track{Artist: "A", Album: "B", Name: "C", Duration: 60000}
+	ps := Playlists{
+		{Name: "P", Tracks: []Track{track, track, {Artist: "A", Album: "B", Name: "D", Duration: 60000}}},
+	}
+	var buf bytes.Buffer
+	if err := ps.WriteCSV(&buf, CSVOptions{Checksum: true}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := func(row []string) string { return strings.TrimSpace(row[len(row)-1]) }
+	if checksum(rows[0]) != "Checksum" {
+		t.Errorf("header = %q, want a Checksum column", rows[0])
+	}
+	if checksum(rows[1]) != checksum(rows[2]) {
+		t.Errorf("identical rows have checksums %s and %s", checksum(rows[1]), checksum(rows[2]))
+	}
+	if checksum(rows[1]) == checksum(rows[3]) {
+		t.Errorf("different rows share checksum %s", checksum(rows[1]))
+	}
+	// Moving text from one field to the next has to change it too
+	if rowChecksum("ab", "c") == rowChecksum("a", "bc") {
+		t.Errorf("checksum ignores field boundaries")
+	}
+}
+
+func TestWriteCSVHeaderDelimiters(t *testing.T) {
+	ps := Playlists{{Name: "My Mix", Tracks: []Track{{Name: "Song", TrackNumber: 3}}}}
+	cols := mustColumns("playlist", "track_number", "name")
+	for _, delim := range []rune{',', ' ', '.', ';', '\t'} {
+		t.Run(fmt.Sprintf("%q", delim), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := ps.WriteCSV(&buf, CSVOptions{Columns: cols, Delimiter: delim, Checksum: true}); err != nil {
+				t.Fatal(err)
+			}
+			r := csv.NewReader(&buf)
+			r.Comma = delim
+			rows, err := r.ReadAll()
+			if err != nil {
+				t.Fatalf("%v\n%s", err, buf.String())
+			}
+			var header []string
+			for _, h := range rows[0] {
+				header = append(header, strings.TrimSpace(h))
+			}
+			if want := []string{"Playlist Name", "Track No.", "Track", "Checksum"}; !reflect.DeepEqual(header, want) {
+				t.Errorf("header = %q, want %q", header, want)
+			}
+			if len(rows[1]) != len(rows[0]) {
+				t.Errorf("row %q has %d fields, header has %d", rows[1], len(rows[1]), len(rows[0]))
+			}
+		})
+	}
+}
+
+func TestWriteJSONChecksum(t *testing.T) {
+	track := Track{Artist: "A", Album: "B", Name: "C", Duration: 60000}
+	ps := Playlists{
+		{Name: "P", Tracks: []Track{track, track, {Artist: "A", Album: "B", Name: "D", Duration: 60000}}},
+	}
+	tests := []struct {
+		name    string
+		columns []Column
+	}{
+		{"tracks", nil},
+		{"columns", mustColumns("artist", "name", "duration")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := ps.WriteJSON(&buf, JSONOptions{Columns: tt.columns, Checksum: true}); err != nil {
+				t.Fatal(err)
+			}
+			var got []struct {
+				Tracks []struct {
+					Checksum string `json:"checksum"`
+				} `json:"tracks"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			sums := got[0].Tracks
+			if sums[0].Checksum == "" || sums[0] != sums[1] {
+				t.Errorf("identical tracks have checksums %q and %q", sums[0].Checksum, sums[1].Checksum)
+			}
+			if sums[0] == sums[2] {
+				t.Errorf("different tracks share checksum %q", sums[0].Checksum)
+			}
+
+			// The checksum is the one the CSV row for the same columns has
+			buf.Reset()
+			if err := ps.WriteCSV(&buf, CSVOptions{Columns: tt.columns, Checksum: true, NoHeader: true}); err != nil {
+				t.Fatal(err)
+			}
+			rows, err := csv.NewReader(&buf).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, row := range rows {
+				if csvSum := row[len(row)-1]; csvSum != sums[i].Checksum {
+					t.Errorf("track %d has checksum %q in JSON but %q in CSV", i, sums[i].Checksum, csvSum)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteOutline(t *testing.T) {
+	ps := Playlists{
+		{Name: "First", Tracks: []Track{{Artist: "A", Name: "One"}, {Artist: "B", Name: "Two"}}},
+		{Name: "Second", Tracks: []Track{{Artist: "C", Name: "Three"}}},
+		{Name: "Empty"},
+	}
+	var buf bytes.Buffer
+	if err := ps.WriteOutline(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `1. First
+  1. A - One
+  2. B - Two
+2. Second
+  1. C - Three
+3. Empty
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
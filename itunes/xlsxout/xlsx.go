@@ -0,0 +1,99 @@
+// Package xlsxout writes playlists as Excel workbooks. It is kept apart from
+// the itunes package so that programs which only parse libraries don't pull
+// in the spreadsheet library.
+package xlsxout
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes"
+	"github.com/xuri/excelize/v2"
+)
+
+// sheetNameReplacer swaps out the characters Excel doesn't allow in sheet
+// names.
+var sheetNameReplacer = strings.NewReplacer(
+	":", "_", "\\", "_", "/", "_", "?", "_", "*", "_", "[", "_", "]", "_",
+)
+
+// sheetName turns a playlist name into a valid, unique Excel sheet name. Sheet
+// names are limited to 31 characters and are compared case-insensitively, so
+// collisions get a numeric suffix.
+func sheetName(name string, used map[string]bool) string {
+	base := sheetNameReplacer.Replace(name)
+	if base == "" {
+		base = "Playlist"
+	}
+	sheet := base
+	for i := 2; ; i++ {
+		if r := []rune(sheet); len(r) > 31 {
+			sheet = string(r[:31])
+		}
+		if !used[strings.ToLower(sheet)] {
+			break
+		}
+		suffix := fmt.Sprintf(" (%d)", i)
+		r := []rune(base)
+		if len(r)+len(suffix) > 31 {
+			r = r[:31-len(suffix)]
+		}
+		sheet = string(r) + suffix
+	}
+	used[strings.ToLower(sheet)] = true
+	return sheet
+}
+
+// Write writes the playlists to the given writer as an Excel workbook with
+// one sheet per playlist. Each sheet has a bold header row followed by the
+// artist, album, and track of every entry, with the column widths sized to fit
+// the widest entry in the same way as the table output. An error is returned
+// if the workbook can't be built or written.
+func Write(w io.Writer, ps itunes.Playlists) error {
+	cols, err := itunes.ParseColumns("artist,album,name")
+	if err != nil {
+		return err
+	}
+	colWidths := ps.ColumnWidths(cols)
+	colHeaders := []interface{}{"Artist", "Album", "Track"}
+
+	f := excelize.NewFile()
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	// A new workbook always has a default sheet; reuse it for the first
+	// playlist rather than leaving an empty sheet behind.
+	defaultSheet := f.GetSheetName(0)
+	used := make(map[string]bool)
+	for i, p := range ps {
+		sheet := sheetName(p.Name, used)
+		if i == 0 {
+			f.SetSheetName(defaultSheet, sheet)
+		} else {
+			f.NewSheet(sheet)
+		}
+		if err := f.SetSheetRow(sheet, "A1", &colHeaders); err != nil {
+			return err
+		}
+		if err := f.SetCellStyle(sheet, "A1", "C1", bold); err != nil {
+			return err
+		}
+		for j, cw := range colWidths {
+			col, _ := excelize.ColumnNumberToName(j + 1)
+			// Pad by 2 to match the table output
+			if err := f.SetColWidth(sheet, col, col, float64(cw+2)); err != nil {
+				return err
+			}
+		}
+		for j, t := range p.Tracks {
+			cell, _ := excelize.CoordinatesToCellName(1, j+2)
+			row := []interface{}{t.Artist, t.Album, t.Name}
+			if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+				return err
+			}
+		}
+	}
+	return f.Write(w)
+}
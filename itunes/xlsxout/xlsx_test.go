@@ -0,0 +1,56 @@
+package xlsxout
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes"
+	"github.com/xuri/excelize/v2"
+)
+
+func TestWrite(t *testing.T) {
+	ps := itunes.Playlists{
+		{Name: "Road Trip", Tracks: []itunes.Track{
+			{Artist: "Rick Astley", Album: "Whenever You Need Somebody", Name: "Never Gonna Give You Up"},
+			{Artist: "OK Go", Album: "Oh No", Name: "Here It Goes Again"},
+		}},
+		{Name: "road trip", Tracks: []itunes.Track{{Artist: "A", Album: "B", Name: "C"}}},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, ps); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatalf("reading the workbook back: %v", err)
+	}
+	if sheets := f.GetSheetList(); !reflect.DeepEqual(sheets, []string{"Road Trip", "road trip (2)"}) {
+		t.Errorf("sheets = %q", sheets)
+	}
+	cells := map[string]string{"A1": "Artist", "C1": "Track", "B2": "Whenever You Need Somebody", "C3": "Here It Goes Again"}
+	for cell, want := range cells {
+		if got, err := f.GetCellValue("Road Trip", cell); err != nil || got != want {
+			t.Errorf("%s = %q, %v, want %q", cell, got, err, want)
+		}
+	}
+}
+
+func TestSheetName(t *testing.T) {
+	used := make(map[string]bool)
+	tests := []struct {
+		name, want string
+	}{
+		{"Mixes: 2020/21", "Mixes_ 2020_21"},
+		{"", "Playlist"},
+		{"PLAYLIST", "PLAYLIST (2)"},
+		{strings.Repeat("x", 40), strings.Repeat("x", 31)},
+		{strings.Repeat("x", 40), strings.Repeat("x", 27) + " (2)"},
+	}
+	for _, tt := range tests {
+		if got := sheetName(tt.name, used); got != tt.want {
+			t.Errorf("sheetName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,298 +1,996 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	flags "github.com/jessevdk/go-flags"
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes"
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes/sqliteout"
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes/xlsxout"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 var Args struct {
-	Path    string `short:"p" long:"path" description:"The path to the iTunes library XML export file" required:"yep"`
-	OutPath string `short:"o" long:"out" description:"The path to the output playlist XML file" default:"playlists.txt"`
-	Debug   bool   `short:"d" long:"debug" description:"Print debug messages"`
-	Format  string `short:"f" long:"format" description:"The output format" choice:"csv" choice:"table" default:"table"`
+	Path            []string `short:"p" long:"path" description:"The path to an iTunes library XML export file, or - for stdin (default: stdin). Can be given more than once to merge libraries"`
+	OutPath         string   `short:"o" long:"out" description:"The path to the output playlist file (a directory for m3u, xspf, and pls, the database for sqlite, or - for stdout)" default:"playlists.txt"`
+	Debug           bool     `short:"d" long:"debug" description:"Print debug messages"`
+	Format          string   `short:"f" long:"format" description:"The output format, or a comma-separated list of formats to write each to a file named after the output path (csv, table, json, ndjson, xlsx, m3u, xspf, pls, sqlite, discography, outline, html, or markdown)" default:"table"`
+	Preview         bool     `long:"preview" description:"Also print a table preview of the first rows to stderr"`
+	NameRegex       string   `long:"name-regex" description:"Only keep tracks whose name matches this regular expression"`
+	EmptyIsValue    bool     `long:"empty-is-value" description:"Keep empty string values instead of replacing them with defaults"`
+	Test            bool     `long:"test" description:"Write nothing; exit 0 if any tracks would be output, 1 otherwise"`
+	Grouping        []string `long:"grouping" description:"Only keep tracks in this grouping (case-insensitive, repeatable)"`
+	ASCIIOnly       bool     `long:"ascii-only" description:"Transliterate non-ASCII characters in the output to ASCII"`
+	MaxBytes        int64    `long:"max-bytes" description:"Stop writing output once it would exceed this many bytes (csv, table, json, ndjson, discography, outline, markdown, and html only)"`
+	AlbumKey        string   `long:"album-key" description:"How tracks are grouped into albums" choice:"artist-album" choice:"album-only" default:"artist-album"`
+	TrimSuffix      []string `long:"trim-suffix" description:"Strip this suffix from track names (case-insensitive, repeatable)"`
+	Sample          int      `long:"sample" description:"Output a single playlist of this many tracks picked at random"`
+	Weight          string   `long:"weight" description:"How --sample weights the tracks it picks" choice:"none" choice:"plays" default:"none"`
+	Seed            int64    `long:"seed" description:"Seed for random sampling, for reproducible output (default: random)"`
+	GroupBy         string   `long:"group-by" description:"Regroup the tracks from all playlists into sections" choice:"none" choice:"decade" choice:"album" default:"none"`
+	RowChecksum     bool     `long:"row-checksum" description:"Append a CRC32 checksum of each row's fields to CSV output, and add it to each track in json output"`
+	SamplePlaylists int      `long:"sample-playlists" description:"Only output this many playlists, picked at random"`
+	WarningsFile    string   `long:"warnings-file" description:"Write any warnings raised during the run to this file as JSON"`
+	Sort            string   `long:"sort" description:"Sort the tracks within each playlist" choice:"none" choice:"artist" choice:"album" choice:"name" choice:"bpm" choice:"key" default:"none"`
+	MinBPM          int      `long:"min-bpm" description:"Only keep tracks with at least this BPM"`
+	MaxBPM          int      `long:"max-bpm" description:"Only keep tracks with at most this BPM"`
+	KeyField        string   `long:"key-field" description:"The track field to read the musical key from" default:"Grouping"`
+	Canonical       bool     `long:"canonical" description:"Produce stable, diffable output: sort playlists by name and tracks by artist, album, then name"`
+	KeepBuiltin     bool     `long:"keep-builtin" description:"Keep the built-in playlists such as Library, Music, and Podcasts"`
+	Playlist        string   `short:"n" long:"playlist" description:"Only keep playlists whose name contains this (case-insensitive)"`
+	Artist          string   `long:"artist" description:"Only keep tracks by this artist (case-insensitive)"`
+	Dedupe          bool     `long:"dedupe" description:"Remove repeated tracks (by default, the same artist, album, and name) within each playlist"`
+	Fold            bool     `long:"fold" description:"Ignore case, accents, and Unicode normalization when --dedupe compares artists, albums, and names"`
+	DedupeBy        string   `long:"dedupe-by" description:"What makes tracks the same for --dedupe; it is an error for a track to lack a persistent ID or location" choice:"metadata" choice:"persistent-id" choice:"location" default:"metadata"`
+	Stats           bool     `long:"stats" description:"Print a summary of the (filtered) library to stderr"`
+	WithLocation    bool     `long:"with-location" description:"Include each track's file location as a column in csv and table output"`
+	CheckFiles      bool     `long:"check-files" description:"Report tracks whose files are missing on disk and exit with a non-zero status if there are any"`
+	MinRating       int      `long:"min-rating" description:"Only keep tracks rated at least this many stars (1-5)"`
+	Flatten         bool     `long:"flatten" description:"Don't prefix playlist names with their folders, and keep folders as playlists"`
+	SkipMissing     bool     `long:"skip-missing" description:"Silently skip playlist entries whose track isn't in the library"`
+	Delimiter       string   `long:"delimiter" description:"The field delimiter for csv output, a single character or \\t for tab" default:","`
+	NoHeader        bool     `long:"no-header" description:"Leave out the header row from csv output"`
+	Compact         bool     `long:"compact" description:"Write json output on a single line rather than indented"`
+	AllTracks       bool     `long:"all-tracks" description:"Output every track in the library, ordered by track ID, rather than the playlists"`
+	AddedAfter      string   `long:"added-after" description:"Only keep tracks added on or after this date (YYYY-MM-DD)"`
+	AddedBefore     string   `long:"added-before" description:"Only keep tracks added before this date (YYYY-MM-DD)"`
+	Regex           bool     `long:"regex" description:"Treat the --playlist and --artist values as regular expressions"`
+	Totals          bool     `long:"totals" description:"End each playlist in table output with its track count and running time"`
+	Columns         string   `long:"columns" description:"A comma-separated list of the columns to write to table, csv, and json output, in order (see --list-columns)"`
+	ColumnsFile     string   `long:"columns-file" description:"Read the --columns list from a file, one column per line or comma-separated; --columns wins if both are given"`
+	Preset          string   `long:"preset" description:"Write a named set of columns; --columns wins if both are given" choice:"minimal" choice:"standard" choice:"full" choice:"dj"`
+	ListColumns     bool     `long:"list-columns" description:"List the columns that can be given to --columns and exit"`
+	RelativePaths   bool     `long:"relative-paths" description:"Write track locations relative to the library's Music Folder"`
+	Color           string   `long:"color" description:"Colour table output; auto colours it only when writing to a terminal" choice:"auto" choice:"always" choice:"never" default:"auto"`
+	Duplicates      bool     `long:"duplicates" description:"Instead of writing the playlists, list the songs (by artist and name) found in more than one playlist to stdout"`
+	IncludeEmpty    bool     `long:"include-empty" description:"Keep playlists that have no tracks"`
+	SmartOnly       bool     `long:"smart-only" description:"Only keep smart playlists"`
+	NoSmart         bool     `long:"no-smart" description:"Leave out smart playlists"`
+	Progress        bool     `long:"progress" description:"Show how far through each library file parsing is, on stderr when it's a terminal"`
+	Normalize       bool     `long:"normalize" description:"Trim whitespace and fold curly quotes and non-breaking spaces in artists, albums, and track names"`
+	Genre           string   `long:"genre" description:"Only keep tracks in this genre (case-insensitive)"`
+	Mkdir           bool     `long:"mkdir" description:"Create the output file's directory if it doesn't exist"`
+	BOM             bool     `long:"bom" description:"Start CSV output with a byte-order mark, which Excel needs to recognise the encoding"`
+	Encoding        string   `long:"encoding" description:"The character encoding of text output" choice:"utf-8" choice:"utf-16le" default:"utf-8"`
+	Quiet           bool     `short:"q" long:"quiet" description:"Print nothing but errors"`
+	ReportMissing   bool     `long:"report-missing" description:"Print how many tracks in the library were missing each field, such as Album, to stderr"`
+	Watch           bool     `long:"watch" description:"After writing the output, keep watching the library files and write it again whenever they change, until interrupted"`
+	DateFormat      string   `long:"date-format" description:"The Go time layout dates are written with in table and CSV output, e.g. 02/01/2006 or 2006-01-02T15:04:05Z07:00" default:"2006-01-02"`
 }
 
-func init() {
-	if _, err := flags.Parse(&Args); err != nil {
-		os.Exit(1)
+// previewRows caps the number of track rows printed by --preview so that a
+// large library doesn't flood the terminal.
+const previewRows = 20
+
+// warnings accumulates every Warning raised during the run so that they can be
+// written out with --warnings-file.
+var warnings []itunes.Warning
+
+// addWarning records a warning for --warnings-file and prints it unless
+// --quiet or --test is set. Playlists with no tracks are common enough
+// (folders have none) that they're only printed as debug messages.
+func addWarning(w itunes.Warning) {
+	warnings = append(warnings, w)
+	if w.Kind == itunes.WarnNoTracks {
+		PrintMsg("Error: " + w.String())
+		return
+	}
+	if !Args.Quiet && !Args.Test {
+		log.Printf("Warning: %s", w)
 	}
 }
 
-type Dict struct {
-	XMLName xml.Name `xml:"dict"`
-	KVs     map[string]interface{}
+// defaulted counts, for --report-missing, the tracks that were given the
+// default value of each field because they were missing it.
+var defaulted = make(map[string]int)
+
+func countDefault(field string) {
+	defaulted[field]++
 }
 
-type Array struct {
-	XMLName xml.Name `xml:"array"`
-	Dicts   []Dict   `xml:"dict"`
+// writeMissingFields writes the --report-missing summary, one "N tracks
+// missing Field" line per field, most often missing first.
+func writeMissingFields(w io.Writer) error {
+	fields := make([]string, 0, len(defaulted))
+	for field := range defaulted {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if defaulted[fields[i]] != defaulted[fields[j]] {
+			return defaulted[fields[i]] > defaulted[fields[j]]
+		}
+		return fields[i] < fields[j]
+	})
+	for _, field := range fields {
+		tracks := "tracks"
+		if defaulted[field] == 1 {
+			tracks = "track"
+		}
+		if _, err := fmt.Fprintf(w, "%d %s missing %s\n", defaulted[field], tracks, field); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (di *Dict) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
-	kvs := make(map[string]interface{})
-	// Loop through all the tokens in this element until we find a closing element
-	// that matches our start element
-	var key string
-	for {
-		t, err := d.Token()
+// writeWarnings writes the accumulated warnings to the given path as an
+// indented JSON array. An empty array is written if there were no warnings.
+func writeWarnings(path string) error {
+	ws := warnings
+	if ws == nil {
+		ws = []itunes.Warning{}
+	}
+	b, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// errOutputLimit is returned by a limitWriter once writing would take the
+// output past the --max-bytes limit.
+var errOutputLimit = errors.New("output size limit reached")
+
+// limitWriter passes writes through to w until a write would take the total
+// past max. That write is rejected outright with errOutputLimit so the output
+// is only ever cut at a write boundary (a CSV row or a table section) rather
+// than part way through one. The JSON and HTML writers reserve room for the
+// end of the document, which a write may not eat into, so that it can still be
+// closed once the output is cut.
+type limitWriter struct {
+	w       io.Writer
+	n       int64
+	max     int64
+	reserve int64
+}
+
+// Reserve implements itunes.Reserver.
+func (lw *limitWriter) Reserve(n int) {
+	lw.reserve = int64(n)
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.n+int64(len(p))+lw.reserve > lw.max {
+		return 0, errOutputLimit
+	}
+	n, err := lw.w.Write(p)
+	lw.n += int64(n)
+	return n, err
+}
+
+// utf16Writer encodes output as UTF-16 on its way to a limitWriter, passing on
+// the room held back for the end of a document at two bytes for each of its
+// characters, which are all ASCII.
+type utf16Writer struct {
+	*transform.Writer
+	lw *limitWriter
+}
+
+// Reserve implements itunes.Reserver.
+func (u utf16Writer) Reserve(n int) {
+	u.lw.Reserve(2 * n)
+}
+
+// truncated reports whether err is the result of hitting the --max-bytes limit,
+// printing a warning if so.
+func truncated(err error) bool {
+	if !errors.Is(err, errOutputLimit) {
+		return false
+	}
+	addWarning(itunes.Warning{
+		Kind:    "truncated",
+		Message: fmt.Sprintf("output truncated to stay within %d bytes", Args.MaxBytes),
+	})
+	return true
+}
+
+// parseLibrary reads and parses the library at path, or from stdin if path is
+// empty or -, exiting if it can't be read.
+func parseLibrary(path string, opts itunes.Options) itunes.Playlists {
+	var itunesFile io.Reader = os.Stdin
+	inputName := "from stdin"
+	if path != "" && path != "-" {
+		file, err := os.Open(path)
 		if err != nil {
-			return err
+			log.Fatalf("Failed to load iTunes library file: '%s'\n", err.Error())
 		}
-		switch ty := t.(type) {
-		case xml.EndElement:
-			if ty.Name.Local == start.Name.Local {
-				// We're done
-				di.KVs = kvs
-				return nil
-			}
-		case xml.StartElement:
-			if ty.Name.Local == "key" {
-				// We're parsing a key
-				var k string
-				if err := d.DecodeElement(&k, &ty); err != nil {
-					return err
-				}
-				key = k
+		defer file.Close()
+		itunesFile = file
+		inputName = path
+		if Args.Progress && !Args.Quiet && isTerminal(os.Stderr) {
+			if fi, err := file.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+				pr := &progressReader{r: file, name: path, size: fi.Size(), pct: -1}
+				defer pr.done()
+				itunesFile = pr
 			}
-			if ty.Name.Local == "integer" {
-				// We're parsing an integer value
-				var v int
-				if err := d.DecodeElement(&v, &ty); err != nil {
-					return err
-				}
-				kvs[key] = v
-			}
-			if ty.Name.Local == "string" {
-				// We're parsing an integer value
-				var v string
-				if err := d.DecodeElement(&v, &ty); err != nil {
-					return err
-				}
-				kvs[key] = v
-			}
-			if ty.Name.Local == "dict" {
-				// We're parsing a nested dict value
-				var v Dict
-				if err := d.DecodeElement(&v, &ty); err != nil {
-					return err
+		}
+	}
+	itunesFile, err := decompress(itunesFile)
+	if err != nil {
+		log.Fatalf("Failed to read gzip-compressed iTunes library %s: %s", inputName, err.Error())
+	}
+	playlists, err := itunes.ParseWithOptions(itunesFile, opts)
+	var syntaxErr *xml.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		log.Fatalf("Failed to parse iTunes library %s: parse error at line %d: %s", inputName, syntaxErr.Line, syntaxErr.Msg)
+	} else if err != nil {
+		log.Fatalf("Failed to parse iTunes library %s: %s", inputName, err.Error())
+	}
+	return playlists
+}
+
+// decompress returns a reader of the decompressed library if r is gzipped,
+// which is detected from the gzip magic number rather than the file name so
+// that compressed libraries can be piped in too. Otherwise the library is
+// read as it is.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return gzipReader{zr}, nil
+	}
+	return br, nil
+}
+
+// gzipReader marks errors from a corrupt gzip stream as such, as otherwise
+// they would surface as puzzling XML parsing failures.
+type gzipReader struct {
+	r io.Reader
+}
+
+func (g gzipReader) Read(p []byte) (int, error) {
+	n, err := g.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("corrupt gzip stream: %w", err)
+	}
+	return n, err
+}
+
+// progressReader prints how much of a file has been read to stderr as a
+// percentage, updating the line each time the percentage changes.
+type progressReader struct {
+	r    io.Reader
+	name string
+	size int64
+	read int64
+	pct  int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.read += int64(n)
+	if pct := pr.read * 100 / pr.size; pct != pr.pct {
+		pr.pct = pct
+		fmt.Fprintf(os.Stderr, "\rParsing %s: %d%%", pr.name, pct)
+	}
+	return n, err
+}
+
+// done ends the progress line.
+func (pr *progressReader) done() {
+	if pr.pct >= 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// writeOutput writes the playlists in the given format to path. M3U, XSPF,
+// and PLS write a file per playlist so the path is a directory rather than a
+// file, and SQLite opens the path as a database.
+func writeOutput(playlists itunes.Playlists, format, path string, columns []itunes.Column, delimiter rune) {
+	var out io.Writer
+	var outFile *os.File
+	if !writesOwnFiles(format) {
+		f, err := createOutput(path)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %s", err.Error())
+		}
+		// Stdout is left open, as --watch writes to it again on every change
+		if f != os.Stdout {
+			defer f.Close()
+		}
+		out = f
+		outFile = f
+		if Args.MaxBytes > 0 {
+			out = &limitWriter{w: f, max: Args.MaxBytes}
+		}
+		if Args.Encoding == "utf-16le" {
+			tw := transform.NewWriter(out, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder())
+			defer func() {
+				if err := tw.Close(); err != nil && !truncated(err) {
+					log.Fatalf("Failed to write %s output to file %s: %s", format, path, err.Error())
 				}
-				kvs[key] = v
+			}()
+			if lw, ok := out.(*limitWriter); ok {
+				out = utf16Writer{tw, lw}
+			} else {
+				out = tw
 			}
-			if ty.Name.Local == "array" {
-				var v Array
-				if err := d.DecodeElement(&v, &ty); err != nil {
-					return err
-				}
-				kvs[key] = v
+		}
+		if Args.BOM && format == "csv" {
+			if _, err := io.WriteString(out, "\ufeff"); err != nil && !truncated(err) {
+				log.Fatalf("Failed to write playlist csv to file %s: %s", path, err.Error())
 			}
 		}
 	}
+	if format == "csv" {
+		if err := playlists.WriteCSV(out, itunes.CSVOptions{
+			Columns:   columns,
+			Checksum:  Args.RowChecksum,
+			Location:  Args.WithLocation,
+			Delimiter: delimiter,
+			NoHeader:  Args.NoHeader,
+		}); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist csv to file %s: %s", path, err.Error())
+		}
+	} else if format == "table" {
+		if err := playlists.WriteTable(out, itunes.TableOptions{
+			Columns:  columns,
+			Location: Args.WithLocation,
+			Totals:   Args.Totals,
+			Color:    useColor(outFile),
+		}); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist table to file %s: %s", path, err.Error())
+		}
+	} else if format == "json" {
+		if err := playlists.WriteJSON(out, itunes.JSONOptions{Columns: columns, Compact: Args.Compact, Checksum: Args.RowChecksum}); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist json to file %s: %s", path, err.Error())
+		}
+	} else if format == "ndjson" {
+		if err := playlists.WriteNDJSON(out); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist ndjson to file %s: %s", path, err.Error())
+		}
+	} else if format == "xlsx" {
+		if err := xlsxout.Write(out, playlists); err != nil {
+			log.Fatalf("Failed to write playlist workbook to file %s: %s", path, err.Error())
+		}
+	} else if format == "m3u" {
+		if err := playlists.WriteM3U(path); err != nil {
+			log.Fatalf("Failed to write m3u playlists to directory %s: %s", path, err.Error())
+		}
+	} else if format == "xspf" {
+		if err := playlists.WriteXSPF(path); err != nil {
+			log.Fatalf("Failed to write xspf playlists to directory %s: %s", path, err.Error())
+		}
+	} else if format == "pls" {
+		if err := playlists.WritePLS(path); err != nil {
+			log.Fatalf("Failed to write pls playlists to directory %s: %s", path, err.Error())
+		}
+	} else if format == "sqlite" {
+		if err := sqliteout.Write(path, playlists); err != nil {
+			log.Fatalf("Failed to write playlists to database %s: %s", path, err.Error())
+		}
+	} else if format == "discography" {
+		if err := playlists.WriteDiscography(out, Args.AlbumKey == "album-only"); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write discography to file %s: %s", path, err.Error())
+		}
+	} else if format == "outline" {
+		if err := playlists.WriteOutline(out); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist outline to file %s: %s", path, err.Error())
+		}
+	} else if format == "html" {
+		if err := playlists.WriteHTML(out); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist html to file %s: %s", path, err.Error())
+		}
+	} else if format == "markdown" {
+		if err := playlists.WriteMarkdown(out); err != nil && !truncated(err) {
+			log.Fatalf("Failed to write playlist markdown to file %s: %s", path, err.Error())
+		}
+	}
 }
 
-type ITunesLib struct {
-	XMLName xml.Name `xml:"plist"`
-	D       Dict     `xml:"dict"`
+// formatExtensions gives the file extension used for each output format when
+// several formats are written at once. Formats that write a directory of
+// playlists have none.
+var formatExtensions = map[string]string{
+	"csv":         ".csv",
+	"table":       ".txt",
+	"json":        ".json",
+	"ndjson":      ".ndjson",
+	"xlsx":        ".xlsx",
+	"m3u":         "",
+	"xspf":        "",
+	"pls":         "",
+	"sqlite":      ".db",
+	"discography": ".discography.txt",
+	"outline":     ".outline.txt",
+	"html":        ".html",
+	"markdown":    ".md",
 }
 
-type Track struct {
-	Artist string
-	Album  string
-	Name   string
+// formatNames returns the output formats in alphabetical order.
+func formatNames() []string {
+	names := make([]string, 0, len(formatExtensions))
+	for name := range formatExtensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-type Playlist struct {
-	Name   string
-	Tracks []Track
+// outputPath returns the path the given format is written to. A single format
+// is written to the output path as it is, but when there are several, each
+// gets the output path with its extension replaced by the format's own.
+func outputPath(outPath, format string, multiple bool) string {
+	if !multiple {
+		return outPath
+	}
+	return strings.TrimSuffix(outPath, filepath.Ext(outPath)) + formatExtensions[format]
 }
 
-type Playlists []Playlist
+// watchInterval is how often --watch checks the library files for changes.
+const watchInterval = 2 * time.Second
 
-// WriteCSV writes the set of playlists to the given writer in CSV format.
-// It writes a header row and fields: playlist name, artist, album, and track.
-// An error is returned if any issues are encountered during this process.
-func (ps Playlists) WriteCSV(w io.Writer) error {
-	// Write header row
-	if _, err := w.Write([]byte("Playlist Name, Artist, Album, Track\n")); err != nil {
-		return err
+// watchLibraries calls run each time any of the library files at paths
+// changes, until interrupted. The paths are looked up afresh on every check,
+// so a library that iTunes replaces by renaming a new file over the old one
+// is noticed too. A change only counts once the file has stopped changing for
+// a whole interval, so that a library is never read while half written.
+func watchLibraries(paths []string, run func()) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	PrintInfo(fmt.Sprintf("Watching %s for changes", strings.Join(paths, ", ")))
+	last := statLibraries(paths)
+	var pending map[string]os.FileInfo
+	for {
+		select {
+		case <-interrupt:
+			PrintInfo("Stopped watching")
+			return
+		case <-ticker.C:
+		}
+		current := statLibraries(paths)
+		if pending != nil && !librariesChanged(pending, current) {
+			PrintMsg("Library changed, writing the playlists again")
+			run()
+			last, pending = current, nil
+		} else if librariesChanged(last, current) {
+			pending = current
+		} else {
+			pending = nil
+		}
 	}
-	// Write playlist data
-	for _, p := range ps {
-		for _, t := range p.Tracks {
-			if _, err := w.Write([]byte(fmt.Sprintf("%s,%s,%s,%s\n", p.Name, t.Artist, t.Album, t.Name))); err != nil {
-				return err
-			}
+}
+
+// statLibraries returns the file info of each library path. Paths that can't
+// be stat-ed, such as while a file is being replaced, are left out.
+func statLibraries(paths []string) map[string]os.FileInfo {
+	infos := make(map[string]os.FileInfo)
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			infos[path] = fi
 		}
 	}
-	return nil
+	return infos
 }
 
-// WriteTable writes out the playlists data as a human-readable table.
-// The column widths are set to match the widest entry and the columns are
-// padded for readability. An error is returned in the event of any processing
-// issues.
-func (ps Playlists) WriteTable(w io.Writer) error {
-	// Loop through playlists once to work out how wide each field needs to be
-	// Set baseline widths based on the desired column headers.
-	plNameWidth := 13 // 'Playlist Name'
-	artistWidth := 6  // 'Artist'
-	albumWidth := 5   // 'Album'
-	trackWidth := 5   // 'Track'
-	for _, p := range ps {
-		if len(p.Name) > plNameWidth {
-			plNameWidth = len(p.Name)
-		}
-		for _, t := range p.Tracks {
-			if len(t.Artist) > artistWidth {
-				artistWidth = len(t.Artist)
-			}
-			if len(t.Album) > albumWidth {
-				albumWidth = len(t.Album)
-			}
-			if len(t.Name) > trackWidth {
-				trackWidth = len(t.Name)
-			}
+// librariesChanged reports whether any library that exists now is a
+// different file, or has a different size or modification time, than before.
+func librariesChanged(before, now map[string]os.FileInfo) bool {
+	for path, fi := range now {
+		old, ok := before[path]
+		if !ok || !os.SameFile(old, fi) || old.Size() != fi.Size() || !old.ModTime().Equal(fi.ModTime()) {
+			return true
 		}
 	}
-	// Pad the calculated widths by 2 so that the table fields have a space at either end.
-	plNameWidth += 2
-	artistWidth += 2
-	albumWidth += 2
-	trackWidth += 2
-	// Actually write the table
-	buf := bytes.NewBuffer(nil)
-	// Write the header row
-	colWidths := []int{plNameWidth, artistWidth, albumWidth, trackWidth}
-	writeDividerRow := func() {
-		for _, cw := range colWidths {
-			buf.WriteString("+")
-			buf.WriteString(strings.Repeat("-", cw))
-		}
-		buf.WriteString("+\n")
-	}
-	writeDividerRow()
-	colHeaders := []string{"Playlist Name", "Artist", "Album", "Track"}
-	for i := 0; i < 4; i++ {
-		buf.WriteString("|")
-		n, _ := buf.WriteString(fmt.Sprintf(" %s ", colHeaders[i]))
-		// Right-pad with spaces
-		if n < colWidths[i] {
-			buf.WriteString(strings.Repeat(" ", colWidths[i]-n))
-		}
-	}
-	buf.WriteString("|\n")
-	writeDividerRow()
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		return err
+	return false
+}
+
+// checkDateFormat returns an error if the time layout is obviously broken:
+// one that doesn't include any of the reference time's fields comes out the
+// same whatever the date, as happens with "YYYY-MM-DD".
+func checkDateFormat(layout string) error {
+	if layout == "" {
+		return errors.New("must not be empty")
 	}
-	buf.Reset()
-	// Write Platlist data
-	for _, p := range ps {
-		for _, t := range p.Tracks {
-			colItems := []string{p.Name, t.Artist, t.Album, t.Name}
-			for i := 0; i < 4; i++ {
-				buf.WriteString("|")
-				n, _ := buf.WriteString(fmt.Sprintf(" %s ", colItems[i]))
-				// Right-pad with spaces
-				if n < colWidths[i] {
-					buf.WriteString(strings.Repeat(" ", colWidths[i]-n))
-				}
+	if time.Date(2001, 11, 22, 13, 14, 15, 0, time.UTC).Format(layout) == layout {
+		return errors.New("contains no date or time fields; use Go's reference time, Mon Jan 2 15:04:05 MST 2006, to lay it out")
+	}
+	return nil
+}
+
+// readColumnsFile reads a column list written one per line, comma-separated,
+// or a mix of the two, and returns it in the comma-separated form that
+// itunes.ParseColumns takes. Blank lines are ignored.
+func readColumnsFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
 			}
-			buf.WriteString("|\n")
 		}
-		// Finish section
-		writeDividerRow()
-		if _, err := w.Write(buf.Bytes()); err != nil {
-			return err
-		}
-		buf.Reset()
 	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s lists no columns", path)
+	}
+	return strings.Join(names, ","), nil
+}
 
+// writesDirectory reports whether the output format writes a directory of
+// playlist files.
+func writesDirectory(format string) bool {
+	return format == "m3u" || format == "xspf" || format == "pls"
+}
+
+// checkOutputDir returns an error if the output directory doesn't exist,
+// unless --mkdir is set, in which case it is created.
+func checkOutputDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if Args.Mkdir {
+			return os.MkdirAll(dir, 0755)
+		}
+		return fmt.Errorf("output directory %s does not exist (use --mkdir to create it)", dir)
+	} else if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
 	return nil
 }
 
-func StringOrDefault(val interface{}, alt string) string {
-	s, ok := val.(string)
-	if !ok {
-		return alt
+// writesOwnFiles reports whether the output format writes to the output path
+// itself rather than through a writer: either a file per playlist, in which
+// case the output path is a directory, or a database.
+func writesOwnFiles(format string) bool {
+	return format == "m3u" || format == "xspf" || format == "pls" || format == "sqlite"
+}
+
+// cutsCleanly reports whether the format is written a record at a time, so
+// that --max-bytes can stop it at a record boundary and still leave valid
+// output. JSON and HTML documents are closed off where they stop.
+func cutsCleanly(format string) bool {
+	switch format {
+	case "csv", "table", "json", "ndjson", "discography", "outline", "markdown", "html":
+		return true
+	}
+	return false
+}
+
+// useColor reports whether table output written to f should be coloured,
+// going by --color. With auto, it is only coloured if f is a terminal.
+func useColor(f *os.File) bool {
+	switch Args.Color {
+	case "always":
+		return true
+	case "never":
+		return false
 	}
-	return s
+	return f != nil && isTerminal(f)
 }
 
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// createOutput opens the output file at path for writing. A path of - means
+// stdout. Named pipes are opened for writing as they are, since another
+// process is reading from them; everything else is created or truncated as
+// usual.
+func createOutput(path string) (*os.File, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		return os.OpenFile(path, os.O_WRONLY, 0)
+	}
+	return os.Create(path)
+}
+
+// PrintMsg prints a debug message if --debug is set. Like all messages, it
+// goes to stderr so that stdout is left for the playlists themselves.
 func PrintMsg(msg string) {
-	if Args.Debug {
-		fmt.Println(msg)
+	if !Args.Debug {
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// PrintInfo prints a message to stderr unless --quiet is set.
+func PrintInfo(msg string) {
+	if Args.Quiet {
+		return
 	}
+	fmt.Fprintln(os.Stderr, msg)
 }
 
 func main() {
-	itunesBytes, err := ioutil.ReadFile(Args.Path)
-	if err != nil {
-		log.Fatalf("Failed to load iTunes library file: '%s'\n", err.Error())
+	if _, err := flags.Parse(&Args); err != nil {
+		os.Exit(1)
 	}
 
-	var i ITunesLib
-	if err := xml.Unmarshal(itunesBytes, &i); err != nil {
-		log.Fatalf("Failed to parse iTunes library file: %s", err.Error())
+	// Validate any filter patterns before doing the expensive parse
+	var nameRe *regexp.Regexp
+	if Args.NameRegex != "" {
+		re, err := regexp.Compile(Args.NameRegex)
+		if err != nil {
+			log.Fatalf("Invalid --name-regex pattern: %s", err.Error())
+		}
+		nameRe = re
+	}
+	if Args.ListColumns {
+		for _, name := range itunes.ColumnNames() {
+			fmt.Println(name)
+		}
+		return
+	}
+	var columns []itunes.Column
+	if Args.Columns != "" {
+		cols, err := itunes.ParseColumns(Args.Columns)
+		if err != nil {
+			log.Fatalf("Invalid --columns: %s", err.Error())
+		}
+		columns = cols
+	} else if Args.ColumnsFile != "" {
+		list, err := readColumnsFile(Args.ColumnsFile)
+		if err != nil {
+			log.Fatalf("Couldn't read --columns-file: %s", err.Error())
+		}
+		cols, err := itunes.ParseColumns(list)
+		if err != nil {
+			log.Fatalf("Invalid --columns-file %s: %s", Args.ColumnsFile, err.Error())
+		}
+		columns = cols
+	} else if Args.Preset != "" {
+		cols, err := itunes.PresetColumns(Args.Preset)
+		if err != nil {
+			log.Fatalf("Invalid --preset: %s", err.Error())
+		}
+		columns = cols
+	}
+	if Args.Quiet && Args.Debug {
+		log.Fatalf("--quiet and --debug cannot be used together")
+	}
+	if Args.SmartOnly && Args.NoSmart {
+		log.Fatalf("--smart-only and --no-smart cannot be used together")
+	}
+	if err := checkDateFormat(Args.DateFormat); err != nil {
+		log.Fatalf("Invalid --date-format %q: %s", Args.DateFormat, err.Error())
+	}
+	columns = itunes.WithDateFormat(columns, Args.DateFormat)
+	var playlistRe, artistRe *regexp.Regexp
+	if Args.Regex && Args.Playlist != "" {
+		re, err := regexp.Compile(Args.Playlist)
+		if err != nil {
+			log.Fatalf("Invalid --playlist pattern: %s", err.Error())
+		}
+		playlistRe = re
+	}
+	if Args.Regex && Args.Artist != "" {
+		re, err := regexp.Compile(Args.Artist)
+		if err != nil {
+			log.Fatalf("Invalid --artist pattern: %s", err.Error())
+		}
+		artistRe = re
+	}
+	var addedAfter, addedBefore time.Time
+	if Args.AddedAfter != "" {
+		t, err := time.Parse("2006-01-02", Args.AddedAfter)
+		if err != nil {
+			log.Fatalf("Invalid --added-after date %q: must be YYYY-MM-DD", Args.AddedAfter)
+		}
+		addedAfter = t
+	}
+	if Args.AddedBefore != "" {
+		t, err := time.Parse("2006-01-02", Args.AddedBefore)
+		if err != nil {
+			log.Fatalf("Invalid --added-before date %q: must be YYYY-MM-DD", Args.AddedBefore)
+		}
+		addedBefore = t
+	}
+	delimiter := ','
+	if Args.Delimiter == `\t` {
+		delimiter = '\t'
+	} else if utf8.RuneCountInString(Args.Delimiter) == 1 {
+		delimiter, _ = utf8.DecodeRuneInString(Args.Delimiter)
+	} else {
+		log.Fatalf("Invalid --delimiter %q: must be a single character", Args.Delimiter)
+	}
+	if delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+		log.Fatalf("Invalid --delimiter %q: cannot be a quote or newline", Args.Delimiter)
+	}
+	formats := strings.Split(Args.Format, ",")
+	for i, format := range formats {
+		formats[i] = strings.TrimSpace(format)
+		if _, ok := formatExtensions[formats[i]]; !ok {
+			log.Fatalf("Invalid --format %q: must be one of %s", formats[i], strings.Join(formatNames(), ", "))
+		}
+	}
+	if Args.OutPath == "-" && len(formats) > 1 {
+		log.Fatalf("Multiple formats cannot be written to stdout")
+	}
+	outPaths := make(map[string]string)
+	for _, format := range formats {
+		path := outputPath(Args.OutPath, format, len(formats) > 1)
+		// The playlist directory formats can share a directory, as their
+		// files have different extensions
+		if other, ok := outPaths[path]; ok && !writesDirectory(format) {
+			log.Fatalf("The %s and %s formats would both be written to %s", other, format, path)
+		}
+		outPaths[path] = format
+		if Args.OutPath == "-" && writesOwnFiles(format) {
+			log.Fatalf("The %s format cannot be written to stdout", format)
+		}
+		if Args.MaxBytes > 0 && !cutsCleanly(format) {
+			log.Fatalf("--max-bytes is not supported for the %s format", format)
+		}
+		if Args.Encoding != "utf-8" && (format == "xlsx" || writesOwnFiles(format)) {
+			log.Fatalf("--encoding is not supported for the %s format", format)
+		}
+		// Check the output file can be created before spending time on the
+		// library. The directory formats create their directory themselves.
+		if path != "-" && !writesDirectory(format) {
+			if err := checkOutputDir(filepath.Dir(path)); err != nil {
+				log.Fatalf("Cannot write to %s: %s", path, err.Error())
+			}
+		}
 	}
 
-	// Extract the tracks as a helpful object
-	rawTracks := i.D.KVs["Tracks"].(Dict)
-	tracks := make(map[string]Track)
-	for trackID, trackDict := range rawTracks.KVs {
-		var t Track
-		td := trackDict.(Dict)
-		t.Artist = StringOrDefault(td.KVs["Artist"], "Unknown Artist")
-		t.Album = StringOrDefault(td.KVs["Album"], "Unknown Album")
-		t.Name = StringOrDefault(td.KVs["Name"], "Unknown Name")
-		tracks[trackID] = t
+	paths := Args.Path
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	if Args.Watch {
+		for _, path := range paths {
+			if path == "" || path == "-" {
+				log.Fatalf("--watch needs library files to watch, not stdin")
+			}
+		}
+		if Args.Test {
+			log.Fatalf("--watch and --test cannot be used together")
+		}
 	}
-	PrintMsg(fmt.Sprintf("Library contains %d tracks", len(tracks)))
 
-	rawPlaylists := i.D.KVs["Playlists"].(Array)
-	PrintMsg(fmt.Sprintf("Library contains %d playlists", len(rawPlaylists.Dicts)))
+	run := func() {
+		// Start each run afresh, as --watch runs it again and again
+		warnings = nil
+		defaulted = make(map[string]int)
 
-	// Convert the playlists into something useful
-	// Start at index 5 to lose the enormous default 'Library',
-	// 'Downloaded', 'Music', 'Podcasts' and 'Albums' playlists.
-	var playlists Playlists
-	for _, d := range rawPlaylists.Dicts[5:] {
-		var p Playlist
-		p.Name = StringOrDefault(d.KVs["Name"], "Unknown Playlist")
-		pTracks, ok := d.KVs["Playlist Items"].(Array)
-		if !ok {
-			PrintMsg(fmt.Sprintf("Error: Playlist %s has no tracks", p.Name))
-			continue
+		// Read the libraries, or a single library from stdin if no path was
+		// given, and merge them together
+		opts := itunes.Options{
+			KeepBuiltin:   Args.KeepBuiltin,
+			IncludeEmpty:  Args.IncludeEmpty,
+			EmptyIsValue:  Args.EmptyIsValue,
+			KeyField:      Args.KeyField,
+			Flatten:       Args.Flatten,
+			SkipMissing:   Args.SkipMissing,
+			AllTracks:     Args.AllTracks,
+			Normalize:     Args.Normalize,
+			RelativePaths: Args.RelativePaths,
+			Defaulted:     countDefault,
+			Warn:          addWarning,
+			Debugf: func(format string, args ...interface{}) {
+				PrintMsg(fmt.Sprintf(format, args...))
+			},
 		}
-		for _, t := range pTracks.Dicts {
-			trackID := t.KVs["Track ID"].(int)
-			tk := tracks[strconv.Itoa(trackID)]
-			p.Tracks = append(p.Tracks, tk)
+		var libs []itunes.Playlists
+		for _, path := range paths {
+			libs = append(libs, parseLibrary(path, opts))
+		}
+		playlists := itunes.Merge(libs...)
+
+		// Apply any filters
+		if Args.Playlist != "" {
+			if playlistRe != nil {
+				playlists = playlists.FilterByPlaylistRegexp(playlistRe)
+			} else {
+				playlists = playlists.FilterByPlaylist(Args.Playlist)
+			}
+			if len(playlists) == 0 && Args.Test {
+				os.Exit(1)
+			} else if len(playlists) == 0 {
+				log.Fatalf("No playlists match '%s'", Args.Playlist)
+			}
+			PrintMsg(fmt.Sprintf("%d playlists match '%s'", len(playlists), Args.Playlist))
+		}
+		if Args.SmartOnly || Args.NoSmart {
+			playlists = playlists.FilterBySmart(Args.SmartOnly)
+			PrintMsg(fmt.Sprintf("%d playlists left after filtering smart playlists", len(playlists)))
+		}
+		if Args.Artist != "" {
+			if artistRe != nil {
+				playlists = playlists.FilterByArtistRegexp(artistRe)
+			} else {
+				playlists = playlists.FilterByArtist(Args.Artist)
+			}
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks by %s", len(playlists), Args.Artist))
+		}
+		if Args.Genre != "" {
+			playlists = playlists.FilterByGenre(Args.Genre)
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks in the %s genre", len(playlists), Args.Genre))
+		}
+		if nameRe != nil {
+			playlists = playlists.FilterByName(nameRe)
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks matching the name filter", len(playlists)))
+		}
+		if len(Args.Grouping) > 0 {
+			playlists = playlists.FilterByGrouping(Args.Grouping)
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks matching the grouping filter", len(playlists)))
 		}
-		playlists = append(playlists, p)
-	}
 
-	PrintMsg(fmt.Sprintf("Parsed %d playlists successfully", len(playlists)))
+		if Args.MinRating > 0 {
+			playlists = playlists.FilterByRating(Args.MinRating)
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks rated %d stars or more", len(playlists), Args.MinRating))
+		}
+		if !addedAfter.IsZero() || !addedBefore.IsZero() {
+			playlists = playlists.FilterByDateAdded(addedAfter, addedBefore)
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks added in the date range", len(playlists)))
+		}
+		if Args.MinBPM > 0 || Args.MaxBPM > 0 {
+			playlists = playlists.FilterByBPM(Args.MinBPM, Args.MaxBPM)
+			PrintMsg(fmt.Sprintf("%d playlists contain tracks in the BPM range", len(playlists)))
+		}
 
-	// Output the playlists helpfully
-	f, _ := os.Create(Args.OutPath)
-	defer f.Close()
-	if Args.Format == "csv" {
-		if err := playlists.WriteCSV(f); err != nil {
-			log.Fatalf("Failed to write playlist csv to file %s: %s", Args.OutPath, err.Error())
+		if Args.Dedupe {
+			for i := range playlists {
+				before := len(playlists[i].Tracks)
+				if err := playlists[i].Dedupe(Args.DedupeBy, Args.Fold); err != nil {
+					log.Fatalf("Couldn't dedupe by %s: %s", Args.DedupeBy, err.Error())
+				}
+				if removed := before - len(playlists[i].Tracks); removed > 0 {
+					PrintMsg(fmt.Sprintf("Removed %d duplicate tracks from playlist %s", removed, playlists[i].Name))
+				}
+			}
 		}
-	} else if Args.Format == "table" {
-		if err := playlists.WriteTable(f); err != nil {
-			log.Fatalf("Failed to write playlist table to file %s: %s", Args.OutPath, err.Error())
+
+		if Args.GroupBy == "decade" {
+			playlists = playlists.GroupByDecade()
+		} else if Args.GroupBy == "album" {
+			playlists = playlists.GroupByAlbum(Args.AlbumKey == "album-only")
+		}
+
+		// Use a random seed for sampling unless the user asked for a specific one,
+		// or wants canonical output which has to be the same every run
+		seed := Args.Seed
+		if seed == 0 && Args.Canonical {
+			seed = 1
+		} else if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		if Args.SamplePlaylists > 0 {
+			playlists = playlists.SamplePlaylists(Args.SamplePlaylists, seed)
+			PrintMsg(fmt.Sprintf("Sampled %d playlists with seed %d", len(playlists), seed))
+		}
+		if Args.Sample > 0 {
+			playlists = playlists.Sample(Args.Sample, Args.Weight == "plays", seed)
+			PrintMsg(fmt.Sprintf("Sampled %d tracks with seed %d", playlists.TrackCount(), seed))
+		}
+
+		if Args.Canonical {
+			playlists.Canonicalize()
+		} else {
+			for i := range playlists {
+				playlists[i].Sort(Args.Sort)
+			}
 		}
+
+		if Args.ASCIIOnly {
+			playlists.ToASCII()
+		}
+		if len(Args.TrimSuffix) > 0 {
+			playlists.TrimNameSuffixes(Args.TrimSuffix)
+		}
+
+		// --test writes nothing at all, so stop before any of the reports
+		if Args.Test {
+			if playlists.TrackCount() > 0 {
+				os.Exit(0)
+			}
+			os.Exit(1)
+		}
+
+		if Args.Stats {
+			if err := playlists.Stats().WriteStats(os.Stderr); err != nil {
+				log.Fatalf("Failed to write library stats: %s", err.Error())
+			}
+		}
+
+		// The duplicates report replaces the playlist output, but the reports
+		// below still apply to it
+		if Args.Duplicates {
+			if err := itunes.WriteDuplicates(os.Stdout, playlists.CrossPlaylistDuplicates()); err != nil {
+				log.Fatalf("Failed to write duplicates report: %s", err.Error())
+			}
+		} else {
+			for _, format := range formats {
+				path := outputPath(Args.OutPath, format, len(formats) > 1)
+				writeOutput(playlists, format, path, columns, delimiter)
+				if path == "-" {
+					PrintInfo("Successfully wrote playlists to stdout")
+				} else {
+					PrintInfo(fmt.Sprintf("Successfully wrote playlists to %s", path))
+				}
+			}
+		}
+
+		if Args.WarningsFile != "" {
+			if err := writeWarnings(Args.WarningsFile); err != nil {
+				log.Fatalf("Failed to write warnings to file %s: %s", Args.WarningsFile, err.Error())
+			}
+		}
+
+		if Args.Preview {
+			if err := playlists.Head(previewRows).WriteTable(os.Stderr, itunes.TableOptions{
+				Columns:  columns,
+				Location: Args.WithLocation,
+				Color:    useColor(os.Stderr),
+			}); err != nil {
+				log.Fatalf("Failed to write playlist preview: %s", err.Error())
+			}
+		}
+
+		if Args.ReportMissing {
+			if err := writeMissingFields(os.Stderr); err != nil {
+				log.Fatalf("Failed to write missing fields report: %s", err.Error())
+			}
+		}
+
+		if Args.CheckFiles {
+			missing := playlists.MissingFiles()
+			if len(missing) > 0 {
+				fmt.Fprintf(os.Stderr, "%d tracks have missing files:\n", len(missing))
+				if err := itunes.WriteMissingFiles(os.Stderr, missing); err != nil {
+					log.Fatalf("Failed to write missing files report: %s", err.Error())
+				}
+				if !Args.Watch {
+					os.Exit(1)
+				}
+			}
+		}
+	}
+	run()
+	if Args.Watch {
+		watchLibraries(paths, run)
 	}
-	PrintMsg(fmt.Sprintf("Successfully wrote playlists to %s", Args.OutPath))
 }
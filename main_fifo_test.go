@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteToFIFO(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "out.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("can't make a FIFO: %v", err)
+	}
+	want, stderr, code := runMain(t, "-p", "itunes.xml", "-f", "csv", "-o", "-")
+	if code != 0 {
+		t.Fatalf("writing to stdout: exit code %d: %s", code, stderr)
+	}
+
+	// Drain the FIFO from another goroutine, as opening it to write blocks
+	// until something opens it to read
+	got := make(chan string)
+	go func() {
+		b, err := ioutil.ReadFile(fifo)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- string(b)
+	}()
+	if _, stderr, code := runMain(t, "-p", "itunes.xml", "-f", "csv", "-o", fifo); code != 0 {
+		t.Fatalf("writing to the FIFO: exit code %d: %s", code, stderr)
+	}
+	if out := <-got; out != want {
+		t.Errorf("read from the FIFO:\n%s\nwant:\n%s", out, want)
+	}
+}
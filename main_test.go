@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/will-dee/itunes-xml-playlist-extract/itunes"
+)
+
+// TestMain runs the program itself rather than the tests when IXPE_RUN_MAIN
+// is set, so that runMain can check its output and exit code.
+func TestMain(m *testing.M) {
+	if os.Getenv("IXPE_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the program with the given arguments, returning what it wrote
+// to stdout and stderr and its exit code.
+func runMain(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "IXPE_RUN_MAIN=1")
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("running %v: %v", args, err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+func TestPreview(t *testing.T) {
+	stdout, stderr, code := runMain(t, "-p", "itunes.xml", "-f", "csv", "-o", "-", "--preview", "-q")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "Playlist Name,") || strings.Contains(stdout, "+---") {
+		t.Errorf("stdout should be just the CSV:\n%s", stdout)
+	}
+	if !strings.HasPrefix(stderr, "+---") || !strings.Contains(stderr, "| Never Gonna Give You Up ") {
+		t.Errorf("stderr should be the table preview:\n%s", stderr)
+	}
+}
+
+func TestAddWarningOutput(t *testing.T) {
+	tests := []struct {
+		name        string
+		quiet, test bool
+		kind        string
+		wantPrinted bool
+	}{
+		{"default", false, false, itunes.WarnMissingTrack, true},
+		{"quiet", true, false, itunes.WarnMissingTrack, false},
+		{"test", false, true, itunes.WarnMissingTrack, false},
+		{"no tracks is debug only", false, false, itunes.WarnNoTracks, false},
+	}
+	saved := Args
+	defer func() { Args = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+			Args.Quiet, Args.Test = tt.quiet, tt.test
+			warnings = nil
+
+			addWarning(itunes.Warning{Kind: tt.kind, Playlist: "P"})
+
+			if len(warnings) != 1 {
+				t.Errorf("recorded %d warnings, want 1", len(warnings))
+			}
+			if printed := buf.Len() > 0; printed != tt.wantPrinted {
+				t.Errorf("printed = %v (%q), want %v", printed, buf.String(), tt.wantPrinted)
+			}
+		})
+	}
+}
+
+func TestLimitWriterTruncation(t *testing.T) {
+	// Outline and Markdown are written a playlist at a time, so give them
+	// several to cut between
+	var ps itunes.Playlists
+	for i := 0; i < 4; i++ {
+		p := itunes.Playlist{Name: fmt.Sprintf("P%d", i)}
+		for j := 0; j < 5; j++ {
+			p.Tracks = append(p.Tracks, itunes.Track{Artist: "Artist", Name: fmt.Sprintf("Track %d", j)})
+		}
+		ps = append(ps, p)
+	}
+	write := map[string]func(w io.Writer) error{
+		"csv":      func(w io.Writer) error { return ps.WriteCSV(w, itunes.CSVOptions{}) },
+		"ndjson":   ps.WriteNDJSON,
+		"outline":  ps.WriteOutline,
+		"markdown": ps.WriteMarkdown,
+		"json":     func(w io.Writer) error { return ps.WriteJSON(w, itunes.JSONOptions{}) },
+		"compact":  func(w io.Writer) error { return ps.WriteJSON(w, itunes.JSONOptions{Compact: true}) },
+		"html":     ps.WriteHTML,
+	}
+	for format, fn := range write {
+		t.Run(format, func(t *testing.T) {
+			var full bytes.Buffer
+			if err := fn(&full); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			lw := &limitWriter{w: &buf, max: int64(full.Len() / 2)}
+			if err := fn(lw); !errors.Is(err, errOutputLimit) {
+				t.Fatalf("err = %v, want errOutputLimit", err)
+			}
+			out := buf.String()
+			if out == "" || len(out) > full.Len()/2 {
+				t.Fatalf("wrote %d of %d bytes with a limit of %d", len(out), full.Len(), full.Len()/2)
+			}
+			// JSON and HTML are cut at a playlist or track and then closed,
+			// so only the part before the closing matches the full output
+			body := out
+			switch format {
+			case "json", "compact":
+				if !json.Valid([]byte(out)) {
+					t.Errorf("invalid JSON:\n%s", out)
+				}
+				var got itunes.Playlists
+				if err := json.Unmarshal([]byte(out), &got); err != nil {
+					t.Fatal(err)
+				}
+				if n := got.TrackCount(); n == 0 || n == 20 {
+					t.Errorf("kept %d of the 20 tracks, want some but not all", n)
+				}
+				body = strings.TrimRight(out, "]}\n ")
+			case "html":
+				if !strings.HasSuffix(out, "</table>\n</body>\n</html>\n") || strings.Count(out, "<table>") != strings.Count(out, "</table>") {
+					t.Errorf("HTML wasn't closed:\n%s", out)
+				}
+				body = strings.TrimSuffix(out, "\n</table>\n</body>\n</html>\n")
+			default:
+				if !strings.HasSuffix(out, "\n") {
+					t.Errorf("output wasn't cut at a line boundary:\n%s", out)
+				}
+			}
+			if !strings.HasPrefix(full.String(), body) {
+				t.Errorf("output doesn't start like the full output:\n%s", out)
+			}
+			if format == "ndjson" {
+				for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+					if !json.Valid([]byte(line)) {
+						t.Errorf("invalid JSON line %q", line)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidNameRegex(t *testing.T) {
+	// The library doesn't exist, so this only passes if the pattern is
+	// checked first
+	_, stderr, code := runMain(t, "-p", "does-not-exist.xml", "--name-regex", "(Live")
+	if code == 0 || !strings.Contains(stderr, "Invalid --name-regex") {
+		t.Errorf("exit code %d, stderr %q; want an invalid pattern error", code, stderr)
+	}
+}
+
+func TestWarningsFile(t *testing.T) {
+	dir := t.TempDir()
+	library := filepath.Join(dir, "library.xml")
+	err := ioutil.WriteFile(library, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>Tracks</key><dict>
+	<key>1</key><dict><key>Track ID</key><integer>1</integer><key>Name</key><string>Found</string></dict>
+</dict>
+<key>Playlists</key><array>
+	<dict><key>Name</key><string>Broken</string><key>Playlist Items</key><array>
+		<dict><key>Track ID</key><integer>1</integer></dict>
+		<dict><key>Track ID</key><integer>2</integer></dict>
+		<dict><key>Track ID</key><string>x</string></dict>
+	</array></dict>
+</array>
+</dict></plist>`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warningsPath := filepath.Join(dir, "warnings.json")
+	stdout, stderr, code := runMain(t, "-p", library, "-f", "csv", "-o", "-", "-q", "--warnings-file", warningsPath)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if stderr != "" || !strings.Contains(stdout, "Found") {
+		t.Errorf("warnings should only go to the file; stdout %q, stderr %q", stdout, stderr)
+	}
+	b, err := ioutil.ReadFile(warningsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []itunes.Warning
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("warnings file isn't a JSON array of warnings: %v\n%s", err, b)
+	}
+	want := []itunes.Warning{
+		{Kind: itunes.WarnMissingTrack, Playlist: "Broken", Message: "track 2 is not in the library"},
+		{Kind: itunes.WarnBadTrackID, Playlist: "Broken", Message: `skipping item with invalid Track ID "x"`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got warnings %+v, want %+v", got, want)
+	}
+}
+
+func TestCanonicalOutput(t *testing.T) {
+	for _, format := range []string{"csv", "json", "table"} {
+		t.Run(format, func(t *testing.T) {
+			args := []string{"-p", "itunes.xml", "-f", format, "-o", "-", "--canonical", "--sample", "3", "-q"}
+			first, stderr, code := runMain(t, args...)
+			if code != 0 {
+				t.Fatalf("exit code %d: %s", code, stderr)
+			}
+			if second, _, _ := runMain(t, args...); second != first {
+				t.Errorf("second run differs:\n%s\nfirst run:\n%s", second, first)
+			}
+		})
+	}
+}
+
+func TestTestFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{"tracks", nil, 0},
+		{"no matching artist", []string{"--artist", "Nobody"}, 1},
+		{"no matching playlist", []string{"--playlist", "Nothing Like This"}, 1},
+		{"stats", []string{"--stats"}, 0},
+		{"duplicates", []string{"--duplicates"}, 0},
+		{"duplicates with no tracks", []string{"--duplicates", "--artist", "Nobody"}, 1},
+		{"preview and reports", []string{"--preview", "--report-missing", "--check-files"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-p", "itunes.xml", "--test"}, tt.args...)
+			stdout, stderr, code := runMain(t, args...)
+			if code != tt.wantCode {
+				t.Errorf("exit code %d, want %d", code, tt.wantCode)
+			}
+			if stdout != "" || stderr != "" {
+				t.Errorf("--test should print nothing; stdout %q, stderr %q", stdout, stderr)
+			}
+		})
+	}
+}
+
+func TestColumnsFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		columns string
+		want    string
+	}{
+		{name: "lines", file: "artist\nname\n\nalbum\n", want: "Artist, Track, Album"},
+		{name: "commas", file: "artist, name,album", want: "Artist, Track, Album"},
+		{name: "mixed", file: "artist,name\r\nalbum\r\n", want: "Artist, Track, Album"},
+		{name: "columns wins", file: "artist\nname\n", columns: "album", want: "Album"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("columns%d.txt", i))
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args := []string{"-p", "itunes.xml", "-f", "csv", "-o", "-", "-q", "--columns-file", path}
+			if tt.columns != "" {
+				args = append(args, "--columns", tt.columns)
+			}
+			stdout, stderr, code := runMain(t, args...)
+			if code != 0 {
+				t.Fatalf("exit code %d: %s", code, stderr)
+			}
+			header := strings.SplitN(stdout, "\n", 2)[0]
+			if header != tt.want {
+				t.Errorf("header = %q, want %q", header, tt.want)
+			}
+		})
+	}
+
+	t.Run("unknown column", func(t *testing.T) {
+		path := filepath.Join(dir, "bad.txt")
+		if err := ioutil.WriteFile(path, []byte("artist\nnope\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, stderr, code := runMain(t, "-p", "itunes.xml", "-f", "csv", "-o", "-", "--columns-file", path)
+		if code == 0 || !strings.Contains(stderr, `unknown column "nope"`) {
+			t.Errorf("exit code %d, stderr %q; want an unknown column error", code, stderr)
+		}
+	})
+}
+
+func TestPreset(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--preset", "minimal"}, want: "Artist, Track"},
+		{args: []string{"--preset", "dj"}, want: "Artist, Track, BPM, Length, Key"},
+		{args: []string{"--preset", "standard"}, want: "Playlist Name, Artist, Album, Track, Genre, Length, Plays, Rating"},
+		{args: []string{"--preset", "minimal", "--columns", "album"}, want: "Album"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			args := append([]string{"-p", "itunes.xml", "-f", "csv", "-o", "-", "-q"}, tt.args...)
+			stdout, stderr, code := runMain(t, args...)
+			if code != 0 {
+				t.Fatalf("exit code %d: %s", code, stderr)
+			}
+			if header := strings.SplitN(stdout, "\n", 2)[0]; header != tt.want {
+				t.Errorf("header = %q, want %q", header, tt.want)
+			}
+		})
+	}
+
+	t.Run("full", func(t *testing.T) {
+		stdout, stderr, code := runMain(t, "-p", "itunes.xml", "-f", "csv", "-o", "-", "-q", "--preset", "full")
+		if code != 0 {
+			t.Fatalf("exit code %d: %s", code, stderr)
+		}
+		header := strings.SplitN(stdout, "\n", 2)[0]
+		if got, want := len(strings.Split(header, ",")), len(itunes.ColumnNames()); got != want {
+			t.Errorf("full preset has %d columns, want %d: %q", got, want, header)
+		}
+	})
+}